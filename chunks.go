@@ -0,0 +1,125 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/overseer-bindiff/fetcher"
+)
+
+// writeChunks splits the binary read from src into content-defined chunks,
+// and stages the ones not published yet, and the (signed) chunk index.
+func writeChunks(pub *publisher, tpl fetcher.Templates, info fetcher.URLInfo, src io.Reader, newSha []byte, keyring openpgp.EntityList, record func(string, genFile) error) error {
+	idx := fetcher.ChunkIndex{Sha256: newSha}
+	staged := make(map[string]bool)
+	var written, size int64
+	err := fetcher.SplitChunks(src, func(c fetcher.Chunk, data []byte) error {
+		idx.Chunks = append(idx.Chunks, c)
+		size += c.Size
+		ui := info
+		ui.ChunkSha = fetcher.EncodeSha(c.Sha256)
+		rel, err := tpl.Execute(tpl.Chunk, ui)
+		if err != nil {
+			return errors.Wrap(err, "execute chunk template")
+		}
+		if staged[rel] {
+			return nil
+		}
+		staged[rel] = true
+		if _, err := os.Stat(pub.Path(rel)); err == nil {
+			return nil
+		}
+		fh, err := pub.Create(rel)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		wc := io.WriteCloser(fh)
+		if keyring != nil {
+			if wc, err = encrypt(fh, filepath.Base(rel), time.Now(), keyring); err != nil {
+				return err
+			}
+		}
+		w := gzip.NewWriter(wc)
+		if _, err = w.Write(data); err == nil {
+			err = w.Close()
+		}
+		if err == nil && keyring != nil {
+			err = wc.Close()
+		}
+		if err == nil {
+			err = fh.Close()
+		}
+		if err != nil {
+			return errors.Wrapf(err, "write chunk %q", fh.Name())
+		}
+		written += c.Size
+		return record(rel, genFile{Kind: kindChunk})
+	})
+	if err != nil {
+		return errors.Wrap(err, "split into chunks")
+	}
+	log.Printf("Split into %d chunks, %d of %d bytes are new.", len(idx.Chunks), written, size)
+
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	rel, err := tpl.Execute(tpl.Index, info)
+	if err != nil {
+		return errors.Wrap(err, "execute index template")
+	}
+	log.Printf("Writing chunk index to %q.", pub.Path(rel))
+	if err = writeSigned(pub, rel, b, keyring); err != nil {
+		return err
+	}
+	return record(rel, genFile{Kind: kindIndex})
+}
+
+// writeSigned stages b as rel, as a signed message if keyring is not nil,
+// so the content and its signature are published in one step.
+func writeSigned(pub *publisher, rel string, b []byte, keyring openpgp.EntityList) error {
+	fh, err := pub.Create(rel)
+	if err != nil {
+		return err
+	}
+	if keyring == nil {
+		_, err = fh.Write(b)
+	} else {
+		err = fetcher.WriteSigned(fh, b, keyring)
+	}
+	if closeErr := fh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return errors.Wrapf(err, "write %q", fh.Name())
+}
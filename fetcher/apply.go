@@ -0,0 +1,189 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// BackupSuffix is appended to the executable's name for the backup of the
+// previous version, for Rollback and the health check's rollback.
+// It is made by Apply, or by saveBackup for the updates handed out to overseer.
+const BackupSuffix = ".old"
+
+var link = os.Link // replaced in the tests
+
+// Apply replaces the target executable with the binary read from bin.
+//
+// The binary is written into a temporary file next to target, synced,
+// given target's permissions, then target is hard linked to target+BackupSuffix,
+// and the new file renamed over it, so there is an executable at target
+// all the time. On Windows, which cannot rename over an existing file,
+// and where hard linking fails, target is moved to target+BackupSuffix first.
+// This works even when target is the running executable.
+func Apply(bin io.Reader, target string) error {
+	target, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return errors.Wrapf(err, "resolve %q", target)
+	}
+	fi, err := os.Stat(target)
+	if err != nil {
+		return errors.Wrapf(err, "stat %q", target)
+	}
+	dir, name := filepath.Split(target)
+	fh, err := ioutil.TempFile(dir, "."+name+".new-")
+	if err != nil {
+		return errors.Wrapf(err, "create temp file next to %q", target)
+	}
+	tmp := fh.Name()
+	_, err = io.Copy(fh, bin)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, fi.Mode().Perm())
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "write %q", tmp)
+	}
+
+	backup := target + BackupSuffix
+	os.Remove(backup)
+	linked := false
+	if runtime.GOOS != "windows" {
+		if err = link(target, backup); err != nil {
+			logf("link %q to %q: %v, moving it away", target, backup, err)
+		}
+		linked = err == nil
+	}
+	if linked {
+		if err = os.Rename(tmp, target); err != nil {
+			os.Remove(tmp)
+			return errors.Wrapf(err, "rename %q to %q", tmp, target)
+		}
+	} else {
+		// Windows cannot rename over an existing file, and some file systems
+		// (vfat, some FUSE and network ones) cannot hard link, so move it away first
+		if err = os.Rename(target, backup); err != nil {
+			os.Remove(tmp)
+			return errors.Wrapf(err, "backup %q to %q", target, backup)
+		}
+		if err = os.Rename(tmp, target); err != nil {
+			if restoreErr := os.Rename(backup, target); restoreErr != nil {
+				logf("restore %q: %+v", target, restoreErr)
+			}
+			os.Remove(tmp)
+			return errors.Wrapf(err, "rename %q to %q", tmp, target)
+		}
+	}
+	syncDir(dir)
+	logf("replaced %q, the previous version is %q", target, backup)
+	return nil
+}
+
+// saveBackup copies target to target+BackupSuffix, as Apply would,
+// for the updates installed by others (overseer).
+// It is not a hard link, as target may be overwritten in place.
+func saveBackup(target string) error {
+	src, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fh, err := os.Create(target + BackupSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fh, src)
+	if closeErr := fh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return errors.Wrapf(err, "save %q", fh.Name())
+}
+
+// Rollback restores the previous version of target, saved by Apply.
+func Rollback(target string) error {
+	target, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return errors.Wrapf(err, "resolve %q", target)
+	}
+	backup := target + BackupSuffix
+	if _, err = os.Stat(backup); err != nil {
+		return errors.Wrap(err, "no previous version")
+	}
+	if err = os.Rename(backup, target); err != nil {
+		// Windows cannot rename over an existing file, so move it away first
+		bad := target + ".bad"
+		os.Remove(bad)
+		if os.Rename(target, bad) != nil {
+			return errors.Wrapf(err, "rename %q to %q", backup, target)
+		}
+		if err = os.Rename(backup, target); err != nil {
+			os.Rename(bad, target)
+			return errors.Wrapf(err, "rename %q to %q", backup, target)
+		}
+		os.Remove(bad) // fails on Windows if it is running
+	}
+	syncDir(filepath.Dir(target))
+	logf("restored %q", target)
+	return nil
+}
+
+// UpdateSelf checks for an update without waiting, and if there is one,
+// Applies it to the running executable. Returns whether it has been updated;
+// the new version runs after a restart.
+func (h *HTTPSelfUpdate) UpdateSelf(ctx context.Context) (bool, error) {
+	if h.Templates.Info == nil {
+		if err := h.Init(); err != nil {
+			return false, err
+		}
+	}
+	bin, err := h.nextUpdate(ctx, false, false) // Apply makes the backup
+	if err != nil || bin == nil {
+		return false, err
+	}
+	if err = Apply(bytes.NewReader(bin), self); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// syncDir syncs the directory, to persist the renames; where possible.
+func syncDir(dir string) {
+	if fh, err := os.Open(dir); err == nil {
+		fh.Sync()
+		fh.Close()
+	}
+}
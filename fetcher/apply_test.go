@@ -0,0 +1,143 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overseer-bindiff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "app")
+	if err = ioutil.WriteFile(target, []byte("old"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	read := func(fn string) string {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	before, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Apply(strings.NewReader("new"), target); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := os.Stat(target + BackupSuffix); err != nil {
+		t.Fatal(err)
+	} else if runtime.GOOS != "windows" && !os.SameFile(before, after) {
+		t.Error("the backup is not a link of the previous target")
+	}
+	if got := read(target); got != "new" {
+		t.Errorf("got %q, awaited new", got)
+	}
+	if got := read(target + BackupSuffix); got != "old" {
+		t.Errorf("backup: got %q, awaited old", got)
+	}
+	if fi, err := os.Stat(target); err != nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("got %v (%v), awaited mode 0750", fi.Mode(), err)
+	}
+
+	if err = Rollback(target); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(target); got != "old" {
+		t.Errorf("after rollback: got %q, awaited old", got)
+	}
+	if err = Rollback(target); err == nil {
+		t.Error("awaited error for rollback without backup")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+		t.Errorf("leftover files: %q", files)
+	}
+}
+
+func TestApplyNoLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overseer-bindiff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "app")
+	if err = ioutil.WriteFile(target, []byte("old"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	// as on vfat, or some FUSE and network file systems
+	defer func() { link = os.Link }()
+	link = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errors.New("operation not permitted")}
+	}
+
+	if err = Apply(strings.NewReader("new"), target); err != nil {
+		t.Fatal(err)
+	}
+	for fn, await := range map[string]string{target: "new", target + BackupSuffix: "old"} {
+		if b, err := ioutil.ReadFile(fn); err != nil || string(b) != await {
+			t.Errorf("%s: got %q (%v), awaited %q", fn, b, err, await)
+		}
+	}
+}
+
+func TestUpdateSelfInit(t *testing.T) {
+	Logf = t.Logf
+	defer func(s string) { self = s }(self)
+	self = "set by another instance"
+	fh, err := os.Open(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := GetSha(fh)
+	fh.Close()
+	infoJSON, err := json.Marshal(Info{Sha256: cur})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(infoJSON)
+	}))
+	defer srv.Close()
+
+	h := HTTPSelfUpdate{URL: srv.URL}
+	if updated, err := h.UpdateSelf(context.Background()); err != nil || updated {
+		t.Errorf("got %t (%+v), awaited no update", updated, err)
+	}
+}
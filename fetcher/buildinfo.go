@@ -0,0 +1,96 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"runtime/debug"
+	"strings"
+)
+
+// BuildInfo is the Go build information of a binary,
+// as recorded in the info manifest.
+type BuildInfo struct {
+	Path      string `json:",omitempty"` // main module path
+	Version   string `json:",omitempty"` // main module version
+	Revision  string `json:",omitempty"` // VCS revision
+	Time      string `json:",omitempty"` // VCS commit time
+	Dirty     bool   `json:",omitempty"` // VCS tree had local modifications
+	GoVersion string `json:",omitempty"`
+}
+
+// NewBuildInfo converts the runtime/debug build info.
+func NewBuildInfo(bi *debug.BuildInfo) *BuildInfo {
+	if bi == nil {
+		return nil
+	}
+	b := BuildInfo{
+		Path:      bi.Main.Path,
+		Version:   bi.Main.Version,
+		GoVersion: bi.GoVersion,
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			b.Revision = s.Value
+		case "vcs.time":
+			b.Time = s.Value
+		case "vcs.modified":
+			b.Dirty = s.Value == "true"
+		}
+	}
+	return &b
+}
+
+// CurrentBuildInfo returns the build info of the running binary, or nil.
+func CurrentBuildInfo() *BuildInfo {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return nil
+	}
+	return NewBuildInfo(bi)
+}
+
+// String returns the version and revision, such as "v1.2.3 rev 0123456789ab-dirty".
+func (b *BuildInfo) String() string {
+	if b == nil {
+		return "unknown"
+	}
+	var parts []string
+	if b.Version != "" {
+		parts = append(parts, b.Version)
+	}
+	if b.Revision != "" {
+		rev := b.Revision
+		if len(rev) > 12 {
+			rev = rev[:12]
+		}
+		if b.Dirty {
+			rev += "-dirty"
+		}
+		parts = append(parts, "rev "+rev)
+	}
+	if len(parts) == 0 {
+		return "unknown"
+	}
+	return strings.Join(parts, " ")
+}
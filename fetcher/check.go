@@ -0,0 +1,121 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// UpdateCheck is the result of CheckForUpdate.
+type UpdateCheck struct {
+	Current []byte     // sha256 of the running binary
+	Build   *BuildInfo // of the running binary, if known
+	Latest  Info       // info of the latest version
+
+	// Available is true if the latest version (or its Replacement, if it is
+	// revoked) differs from the running one, and it is not blacklisted.
+	Available bool
+	// Revoked is true if the running version has been revoked.
+	Revoked bool
+	// BelowMinimum is true if the running version is older than the minimum
+	// supported release; Latest.Critical tells whether the update is critical.
+	BelowMinimum bool
+	// DiffSize and BinSize are the download sizes of the diff from the running
+	// binary, and of the full binary; -1 if not published or unknown.
+	// DiffSize covers the bsdiff and zstd diffs only: without such a diff,
+	// the update is assembled from the chunks or the zsync blocks of the
+	// running binary if they are published, and only the missing parts are
+	// downloaded, which is not known in advance.
+	DiffSize, BinSize int64
+	// ChunksAvailable and ZsyncAvailable tell whether the chunks and the
+	// zsync blocks of the latest version are published.
+	ChunksAvailable, ZsyncAvailable bool
+}
+
+// CheckForUpdate fetches the info of the latest version, and the sizes
+// of the diff and the full binary, without downloading or applying them.
+//
+// Unlike FetchContext, it neither reads nor modifies the state of h
+// (such as h.Info), so it can be called from any goroutine.
+func (h *HTTPSelfUpdate) CheckForUpdate(ctx context.Context) (UpdateCheck, error) {
+	check := UpdateCheck{Build: h.CurrentBuild(), DiffSize: -1, BinSize: -1}
+	fh, err := os.Open(self)
+	if err != nil {
+		return check, errors.Wrapf(err, "open %q", self)
+	}
+	check.Current = GetSha(fh)
+	fh.Close()
+
+	if check.Latest, err = h.readInfo(ctx); err != nil {
+		return check, err
+	}
+	check.Revoked = check.Latest.IsRevoked(check.Current)
+	check.BelowMinimum = check.Latest.BelowMinimum(check.Current)
+	target, ok := check.Latest.Target()
+	check.Available = ok && !bytes.Equal(check.Current, target.Sha256) && !IsBlacklisted(target.Sha256)
+	if !check.Available {
+		return check, nil
+	}
+	check.ChunksAvailable, check.ZsyncAvailable = target.Chunked, target.Zsync
+
+	ctx, cancel := getTimeoutCtx(ctx, h.FetchInfoTimeout, DefaultFetchInfoTimeout)
+	defer cancel()
+	if path, err := h.pathOf("diff", target, check.Current, target.Sha256); err == nil {
+		check.DiffSize = fetchSize(ctx, h.URL+"/"+path)
+	}
+	if path, err := h.pathOf("bin", target, nil, target.Sha256); err == nil {
+		check.BinSize = fetchSize(ctx, h.URL+"/"+path)
+	}
+	return check, nil
+}
+
+// fetchSize returns the size of URL with a HEAD request, -1 if unknown.
+func fetchSize(ctx context.Context, URL string) int64 {
+	if strings.HasPrefix(URL, "file://") { // great for testing
+		fi, err := os.Stat(URL[7:])
+		if err != nil {
+			return -1
+		}
+		return fi.Size()
+	}
+	req, err := http.NewRequest("HEAD", URL, nil)
+	if err != nil {
+		return -1
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		logf("HEAD %q: %+v", URL, err)
+		return -1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return -1
+	}
+	return resp.ContentLength
+}
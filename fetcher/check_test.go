@@ -0,0 +1,144 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckForUpdate(t *testing.T) {
+	self = os.Args[0]
+	fh, err := os.Open(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := GetSha(fh)
+	fh.Close()
+
+	info := Info{Sha256: GetSha(strings.NewReader("new")), Compression: CompressZstd}
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/info.json":
+			w.Write(infoJSON)
+		case "/diff/" + EncodeSha(cur):
+			w.Write([]byte("0123"))
+		case "/bin.zst":
+			w.Write([]byte("0123456789"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	h := HTTPSelfUpdate{URL: srv.URL}
+	if err := h.Templates.Init("info.json", "diff/{{.OldSha}}", "bin{{.CompressionExt}}"); err != nil {
+		t.Fatal(err)
+	}
+	check, err := h.CheckForUpdate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !check.Available || check.DiffSize != 4 || check.BinSize != 10 {
+		t.Errorf("got %+v", check)
+	}
+	if check.ChunksAvailable || check.ZsyncAvailable {
+		t.Errorf("got %+v, awaited no chunks nor zsync", check)
+	}
+	if h.Info.Sha256 != nil {
+		t.Errorf("h.Info has been modified: %+v", h.Info)
+	}
+
+	// no diff, but chunks and zsync blocks
+	info.Chunked, info.Zsync = true, true
+	if infoJSON, err = json.Marshal(info); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Templates.Init("info.json", "nodiff/{{.OldSha}}", "bin{{.CompressionExt}}"); err != nil {
+		t.Fatal(err)
+	}
+	if check, err = h.CheckForUpdate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if check.DiffSize != -1 || !check.ChunksAvailable || !check.ZsyncAvailable {
+		t.Errorf("got %+v, awaited no diff, but chunks and zsync", check)
+	}
+}
+
+func TestCheckForUpdateConcurrent(t *testing.T) {
+	Logf = func(string, ...interface{}) {}
+	defer withSelf(t, "old")()
+
+	newSha := GetSha(strings.NewReader("new"))
+	infoJSON, err := json.Marshal(Info{Sha256: newSha})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/info.json" {
+			w.Write(infoJSON)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	h := HTTPSelfUpdate{URL: srv.URL}
+	if err := h.Templates.Init("info.json", "diff/{{.OldSha}}", "bin.gz"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			h.fetchUpdate(ctx) // writes h.Info
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		check, err := h.CheckForUpdate(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !check.Available {
+			t.Errorf("got %+v, awaited available", check)
+		}
+	}
+	<-done
+
+	if err = addBlacklist(newSha); err != nil {
+		t.Fatal(err)
+	}
+	if check, err := h.CheckForUpdate(ctx); err != nil || check.Available {
+		t.Errorf("got %+v (%v), awaited the blacklisted release not to be available", check, err)
+	}
+}
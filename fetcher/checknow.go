@@ -0,0 +1,76 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+)
+
+// CheckNow wakes up the waiting FetchContext, to check for an update
+// immediately; the following checks keep the Interval.
+//
+// It does not block, and it is a no-op before Init.
+func (h *HTTPSelfUpdate) CheckNow() {
+	select {
+	case h.checkNow <- struct{}{}:
+	default: // a check is already requested (or not initialized)
+	}
+}
+
+// NotifySignal calls CheckNow on each of the given signals (such as syscall.SIGUSR1),
+// till the returned stop function is called.
+func (h *HTTPSelfUpdate) NotifySignal(sigs ...os.Signal) (stop func()) {
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, sigs...)
+	go func() {
+		for {
+			select {
+			case sig := <-c:
+				logf("got %s, checking for update", sig)
+				h.CheckNow()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
+
+// CheckNowHandler returns a handler for an admin endpoint, which calls CheckNow on POST.
+func (h *HTTPSelfUpdate) CheckNowHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.CheckNow()
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckNow(t *testing.T) {
+	h := &HTTPSelfUpdate{Interval: time.Hour, delay: true, checkNow: make(chan struct{}, 1)}
+	if err := h.Templates.Init("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.CheckNowHandler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got %d", w.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	time.AfterFunc(10*time.Millisecond, func() {
+		w := httptest.NewRecorder()
+		h.CheckNowHandler().ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+		if w.Code != http.StatusAccepted {
+			t.Errorf("POST: got %d", w.Code)
+		}
+		h.CheckNow() // does not block
+	})
+	// the check itself fails, as there is no URL
+	if _, err := h.FetchContext(ctx); err == nil || ctx.Err() != nil {
+		t.Errorf("got %v (%v), awaited a check", err, ctx.Err())
+	}
+}
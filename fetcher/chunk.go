@@ -0,0 +1,260 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/pkg/errors"
+)
+
+// Content-defined chunking parameters.
+const (
+	MinChunkSize = 16 << 10
+	AvgChunkSize = 64 << 10
+	MaxChunkSize = 256 << 10
+)
+
+// Chunk is a content-defined chunk of a binary.
+type Chunk struct {
+	Sha256 []byte
+	Size   int64
+}
+
+// ChunkIndex lists the chunks of a binary, in order.
+type ChunkIndex struct {
+	Sha256 []byte // of the whole binary
+	Chunks []Chunk
+}
+
+// gearTable is the random table of the gear rolling hash,
+// generated deterministically with splitmix64.
+var gearTable = func() (t [256]uint64) {
+	x := uint64(0x6f76657273656572) // "overseer"
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+const (
+	// FastCDC normalized chunking: harder to cut below the average size,
+	// easier above it.
+	chunkMaskSmall = uint64(1<<18-1) << 46
+	chunkMaskLarge = uint64(1<<14-1) << 50
+)
+
+// cutPoint returns the length of the next chunk at the beginning of b.
+func cutPoint(b []byte) int {
+	if len(b) <= MinChunkSize {
+		return len(b)
+	}
+	n := len(b)
+	if n > MaxChunkSize {
+		n = MaxChunkSize
+	}
+	normal := AvgChunkSize
+	if normal > n {
+		normal = n
+	}
+	var h uint64
+	i := MinChunkSize
+	for ; i < normal; i++ {
+		if h = (h << 1) + gearTable[b[i]]; h&chunkMaskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		if h = (h << 1) + gearTable[b[i]]; h&chunkMaskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// SplitChunks splits r into content-defined chunks, and calls fn with each,
+// in order. The data passed to fn is only valid during the call.
+func SplitChunks(r io.Reader, fn func(Chunk, []byte) error) error {
+	buf := make([]byte, 2*MaxChunkSize)
+	var start, end int
+	var eof bool
+	for {
+		if !eof && end-start < MaxChunkSize {
+			end = copy(buf, buf[start:end])
+			start = 0
+			n, err := io.ReadFull(r, buf[end:])
+			end += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if start == end {
+			return nil
+		}
+		data := buf[start:end]
+		data = data[:cutPoint(data)]
+		h := NewSha()
+		h.Write(data)
+		if err := fn(Chunk{Sha256: h.Sum(nil), Size: int64(len(data))}, data); err != nil {
+			return err
+		}
+		start += len(data)
+	}
+}
+
+// fetchAndVerifyChunks downloads the signed chunk index of the latest version,
+// and assembles the new binary from the chunks found in old, and the
+// downloaded missing ones.
+func (h *HTTPSelfUpdate) fetchAndVerifyChunks(ctx context.Context, old io.ReadSeeker) ([]byte, error) {
+	if old == nil {
+		return nil, errors.New("empty old")
+	}
+	ctx, cancel := getTimeoutCtx(ctx, h.FetchBinTimeout, DefaultFetchBinTimeout)
+	defer cancel()
+	path, err := h.getPath("index", nil, h.Info.Sha256)
+	if err != nil {
+		return nil, err
+	}
+	b, err := h.fetchSigned(ctx, h.URL+"/"+path)
+	if err != nil {
+		return nil, err
+	}
+	var idx ChunkIndex
+	if err = json.Unmarshal(b, &idx); err != nil {
+		return nil, errors.Wrapf(err, "decode chunk index %q", path)
+	}
+	if !bytes.Equal(idx.Sha256, h.Info.Sha256) {
+		return nil, errors.Wrap(ErrHashMismatch, "chunk index")
+	}
+
+	// index the chunks of the running binary
+	type location struct{ offset, size int64 }
+	have := make(map[string]location)
+	var offset int64
+	if err = SplitChunks(old, func(c Chunk, _ []byte) error {
+		have[string(c.Sha256)] = location{offset: offset, size: c.Size}
+		offset += c.Size
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "split old binary")
+	}
+
+	var buf bytes.Buffer
+	var reused, downloaded int64
+	for _, c := range idx.Chunks {
+		if loc, ok := have[string(c.Sha256)]; ok && loc.size == c.Size {
+			if _, err = old.Seek(loc.offset, io.SeekStart); err != nil {
+				return nil, err
+			}
+			if _, err = io.CopyN(&buf, old, loc.size); err != nil {
+				return nil, errors.Wrap(err, "read old chunk")
+			}
+			reused += c.Size
+			continue
+		}
+		data, err := h.fetchChunk(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+		downloaded += c.Size
+	}
+	logf("assembled binary from chunks: reused %d, downloaded %d bytes", reused, downloaded)
+	return buf.Bytes(), nil
+}
+
+func (h *HTTPSelfUpdate) fetchChunk(ctx context.Context, c Chunk) ([]byte, error) {
+	ui := h.urlInfo(nil, h.Info.Sha256)
+	ui.ChunkSha = EncodeSha(c.Sha256)
+	path, err := h.Templates.Execute(h.Templates.Chunk, ui)
+	if err != nil {
+		return nil, err
+	}
+	r, err := fetch(ctx, h.URL+"/"+path, h.Keyring)
+	if err != nil {
+		return nil, errors.WithMessage(err, "fetchChunk")
+	}
+	defer r.Close()
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "gzip")
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(gz, c.Size+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "read chunk %q", path)
+	}
+	if int64(len(data)) != c.Size || !verifySha(data, c.Sha256) {
+		return nil, errors.Wrapf(ErrHashMismatch, "chunk %q", path)
+	}
+	return data, nil
+}
+
+// fetchSigned fetches the URL, and when Keyring is set, checks its signature:
+// the file is a signed message (see WriteSigned), or, as published by the
+// earlier versions, it has a detached signature at URL + ".asc".
+func (h *HTTPSelfUpdate) fetchSigned(ctx context.Context, URL string) ([]byte, error) {
+	r, err := fetch(ctx, URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	if IsSignedMessage(b) {
+		b, err = ReadSigned(b, h.Keyring)
+		return b, errors.Wrapf(err, "read %q", URL)
+	}
+	if !HasKeys(h.Keyring) {
+		return b, nil
+	}
+	r, err = fetch(ctx, URL+".asc", nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = openpgp.CheckArmoredDetachedSignature(h.Keyring, bytes.NewReader(b), r)
+	r.Close()
+	if err != nil {
+		if el, ok := h.Keyring.(openpgp.EntityList); ok {
+			for _, e := range el {
+				logf("%q", e.Identities)
+			}
+		}
+		return nil, errors.Wrapf(ErrBadSignature, "check %q with %q: %v", b, h.Keyring, err)
+	}
+	return b, nil
+}
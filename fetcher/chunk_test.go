@@ -0,0 +1,103 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestChunks(t *testing.T) {
+	Logf = t.Logf
+	rnd := rand.New(rand.NewSource(2))
+	old := make([]byte, 4<<20)
+	rnd.Read(old)
+	cur := append(append(append([]byte{}, old[:1<<20]...), "inserted"...), old[1<<20:]...)
+
+	split := func(b []byte) ChunkIndex {
+		idx := ChunkIndex{Sha256: GetSha(bytes.NewReader(b))}
+		if err := SplitChunks(bytes.NewReader(b), func(c Chunk, data []byte) error {
+			if c.Size < MinChunkSize && len(idx.Chunks) != 0 || c.Size > MaxChunkSize {
+				t.Errorf("chunk size %d out of range", c.Size)
+			}
+			idx.Chunks = append(idx.Chunks, c)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return idx
+	}
+	idx := split(cur)
+
+	// serve the index and the chunks
+	chunks := make(map[string][]byte)
+	var offset int64
+	for _, c := range idx.Chunks {
+		chunks["/chunks/"+EncodeSha(c.Sha256)] = gzipped(string(cur[offset : offset+c.Size]))
+		offset += c.Size
+	}
+	idxJSON, err := json.Marshal(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var downloaded int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.json" {
+			w.Write(idxJSON)
+			return
+		}
+		if b, ok := chunks[r.URL.Path]; ok && strings.HasPrefix(r.URL.Path, "/chunks/") {
+			atomic.AddInt32(&downloaded, 1)
+			w.Write(b)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	h := HTTPSelfUpdate{URL: srv.URL, IndexPath: "index.json", ChunkPath: "chunks/{{.ChunkSha}}"}
+	if err := h.Templates.Init("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Templates.InitChunks(h.IndexPath, h.ChunkPath); err != nil {
+		t.Fatal(err)
+	}
+	h.Info.Sha256, h.Info.Chunked = idx.Sha256, true
+	got, err := h.fetchAndVerifyChunks(context.Background(), bytes.NewReader(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, cur) {
+		t.Fatal("assembled binary mismatch")
+	}
+	if n := int(atomic.LoadInt32(&downloaded)); n == 0 || n > 2 {
+		t.Errorf("downloaded %d of %d chunks, awaited 1 or 2", n, len(idx.Chunks))
+	}
+}
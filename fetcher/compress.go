@@ -0,0 +1,133 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+// Names of the compressions of the full binaries.
+const (
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+	CompressXz   = "xz"
+	CompressNone = "none"
+)
+
+// Compressions lists the supported compressions.
+var Compressions = []string{CompressGzip, CompressZstd, CompressXz, CompressNone}
+
+// CompressionExt returns the file name extension of the compression.
+// The empty name means CompressGzip.
+func CompressionExt(name string) string {
+	switch name {
+	case "", CompressGzip:
+		return ".gz"
+	case CompressZstd:
+		return ".zst"
+	case CompressXz:
+		return ".xz"
+	}
+	return ""
+}
+
+var compressionMagics = []struct {
+	name  string
+	magic []byte
+}{
+	{CompressGzip, []byte{0x1f, 0x8b}},
+	{CompressZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{CompressXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// SniffCompression returns the compression of the data starting with b,
+// by its magic bytes; CompressNone if unknown.
+func SniffCompression(b []byte) string {
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(b, m.magic) {
+			return m.name
+		}
+	}
+	return CompressNone
+}
+
+// NewCompressor returns a writer compressing into w.
+// The empty name means CompressGzip.
+func NewCompressor(name string, w io.Writer) (io.WriteCloser, error) {
+	switch name {
+	case "", CompressGzip:
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	case CompressZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	case CompressXz:
+		return xz.NewWriter(w)
+	case CompressNone:
+		return nopWriteCloser{w}, nil
+	}
+	return nil, errors.Errorf("unknown compression %q", name)
+}
+
+// NewDecompressor returns a reader decompressing r.
+// The empty name means CompressGzip.
+func NewDecompressor(name string, r io.Reader) (io.ReadCloser, error) {
+	switch name {
+	case "", CompressGzip:
+		gr, err := gzip.NewReader(r)
+		return gr, errors.Wrap(err, "gzip")
+	case CompressZstd:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, errors.Wrap(err, "zstd")
+		}
+		return zr.IOReadCloser(), nil
+	case CompressXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "xz")
+		}
+		return ioutil.NopCloser(xr), nil
+	case CompressNone:
+		return ioutil.NopCloser(r), nil
+	}
+	return nil, errors.Errorf("unknown compression %q", name)
+}
+
+// NewSniffingDecompressor returns a reader decompressing r, with the compression
+// detected by SniffCompression.
+func NewSniffingDecompressor(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(8)
+	return NewDecompressor(SniffCompression(magic), br)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,61 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCompressions(t *testing.T) {
+	data := bytes.Repeat([]byte("overseer-bindiff "), 1000)
+	for _, name := range Compressions {
+		var buf bytes.Buffer
+		w, err := NewCompressor(name, &buf)
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		if _, err = w.Write(data); err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		if got := SniffCompression(buf.Bytes()); got != name {
+			t.Errorf("%s: sniffed %q", name, got)
+		}
+		r, err := NewDecompressor(name, &buf)
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: round trip mismatch", name)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/kr/binarydist"
+	"github.com/pkg/errors"
+)
+
+// Names of the built-in diff formats.
+const (
+	DiffBsdiff = "bsdiff"
+	DiffZstd   = "zstd"
+)
+
+// DiffFormat calculates and applies binary diffs.
+type DiffFormat interface {
+	// Diff writes the patch which transforms old into new.
+	Diff(old, new io.Reader, patch io.Writer) error
+	// Patch applies the patch to old, and writes the result into new.
+	Patch(old io.Reader, new io.Writer, patch io.Reader) error
+}
+
+var (
+	diffFormatsMu sync.RWMutex
+	diffFormats   = map[string]DiffFormat{
+		DiffBsdiff: bsdiff{},
+		DiffZstd:   zstdDiff{},
+	}
+)
+
+// RegisterDiffFormat registers the diff format under the given name,
+// to be usable by generate and by HTTPSelfUpdate.
+func RegisterDiffFormat(name string, format DiffFormat) {
+	diffFormatsMu.Lock()
+	diffFormats[name] = format
+	diffFormatsMu.Unlock()
+}
+
+// GetDiffFormat returns the diff format registered under the given name.
+// The empty name means DiffBsdiff.
+func GetDiffFormat(name string) (DiffFormat, error) {
+	if name == "" {
+		name = DiffBsdiff
+	}
+	diffFormatsMu.RLock()
+	format, ok := diffFormats[name]
+	diffFormatsMu.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("unknown diff format %q", name)
+	}
+	return format, nil
+}
+
+// DiffFormats returns the names of the registered diff formats.
+func DiffFormats() []string {
+	diffFormatsMu.RLock()
+	names := make([]string, 0, len(diffFormats))
+	for nm := range diffFormats {
+		names = append(names, nm)
+	}
+	diffFormatsMu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// bsdiff is the github.com/kr/binarydist implementation of bsdiff.
+type bsdiff struct{}
+
+func (bsdiff) Diff(old, new io.Reader, patch io.Writer) error {
+	return binarydist.Diff(old, new, patch)
+}
+func (bsdiff) Patch(old io.Reader, new io.Writer, patch io.Reader) error {
+	return binarydist.Patch(old, new, patch)
+}
+
+// zstdDiff compresses the new binary with zstd, using the old binary as a raw
+// dictionary, just as "zstd --patch-from" does.
+//
+// It needs much less memory and time than bsdiff, but both sides need
+// to hold the whole old and new binary in memory.
+type zstdDiff struct{}
+
+const zstdDictID = 1
+
+func (zstdDiff) Diff(old, new io.Reader, patch io.Writer) error {
+	oldB, err := ioutil.ReadAll(old)
+	if err != nil {
+		return errors.Wrap(err, "read old")
+	}
+	newB, err := ioutil.ReadAll(new)
+	if err != nil {
+		return errors.Wrap(err, "read new")
+	}
+	// the window must reach back to the beginning of the dictionary
+	window := zstd.MinWindowSize
+	for window < len(oldB)+len(newB) && window < zstd.MaxWindowSize {
+		window <<= 1
+	}
+	enc, err := zstd.NewWriter(nil,
+		zstd.WithEncoderDictRaw(zstdDictID, oldB),
+		zstd.WithWindowSize(window),
+		zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+		zstd.WithEncoderConcurrency(1),
+	)
+	if err != nil {
+		return errors.Wrap(err, "zstd encoder")
+	}
+	defer enc.Close()
+	_, err = patch.Write(enc.EncodeAll(newB, nil))
+	return err
+}
+
+func (zstdDiff) Patch(old io.Reader, new io.Writer, patch io.Reader) error {
+	oldB, err := ioutil.ReadAll(old)
+	if err != nil {
+		return errors.Wrap(err, "read old")
+	}
+	patchB, err := ioutil.ReadAll(patch)
+	if err != nil {
+		return errors.Wrap(err, "read patch")
+	}
+	dec, err := zstd.NewReader(nil,
+		zstd.WithDecoderDictRaw(zstdDictID, oldB),
+		zstd.WithDecoderMaxWindow(zstd.MaxWindowSize),
+		zstd.WithDecoderConcurrency(1),
+	)
+	if err != nil {
+		return errors.Wrap(err, "zstd decoder")
+	}
+	defer dec.Close()
+	newB, err := dec.DecodeAll(patchB, nil)
+	if err != nil {
+		return errors.Wrap(err, "zstd decode")
+	}
+	_, err = new.Write(newB)
+	return err
+}
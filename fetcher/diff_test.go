@@ -0,0 +1,61 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDiffFormats(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	old := make([]byte, 1<<20)
+	rnd.Read(old)
+	cur := append(append(append([]byte{}, old[:1<<19]...), "inserted"...), old[1<<19+100:]...)
+	for i := 0; i < 10; i++ {
+		cur[rnd.Intn(len(cur))] ^= 0xff
+	}
+
+	for _, name := range DiffFormats() {
+		format, err := GetDiffFormat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var patch bytes.Buffer
+		if err := format.Diff(bytes.NewReader(old), bytes.NewReader(cur), &patch); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		t.Logf("%s: patch size %d", name, patch.Len())
+		var got bytes.Buffer
+		if err := format.Patch(bytes.NewReader(old), &got, &patch); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got.Bytes(), cur) {
+			t.Errorf("%s: patched binary mismatch", name)
+		}
+	}
+	if _, err := GetDiffFormat("nonexistent"); err == nil {
+		t.Error("got no error for an unknown format")
+	}
+}
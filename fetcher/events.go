@@ -0,0 +1,84 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+// The ways an update can be assembled, as passed to the EventHandler.
+const (
+	MethodDiff   = "diff"
+	MethodChunks = "chunks"
+	MethodZsync  = "zsync"
+	MethodFull   = "full"
+
+	// MethodInfo is passed to VerificationFailed when the info's signature does not match.
+	MethodInfo = "info"
+)
+
+// EventHandler receives the events of the update lifecycle,
+// for driving UI, telemetry or alerts. The methods are called synchronously,
+// from the goroutine fetching the update, so they should return quickly.
+//
+// Embed NopEventHandler to implement only some of them.
+type EventHandler interface {
+	// CheckStarted is called before fetching the info.
+	CheckStarted()
+	// NoUpdate is called when the running binary is the latest usable release.
+	NoUpdate(latest Info)
+	// UpdateFound is called when the latest release is to be downloaded.
+	UpdateFound(latest Info)
+	// DownloadProgress is called with the bytes read from URL, and its total size (-1 if unknown),
+	// as OnProgress.
+	DownloadProgress(URL string, read, total int64)
+	// PatchApplied is called when the running binary has been patched into the new one,
+	// with MethodDiff, MethodChunks or MethodZsync.
+	PatchApplied(method string)
+	// FallbackToFull is called when the full binary is to be downloaded,
+	// as patching the running binary failed with err.
+	FallbackToFull(err error)
+	// VerificationFailed is called when the binary got by method does not match the info,
+	// or the signature of the info, the chunk index or the zsync control does not match.
+	VerificationFailed(method string, err error)
+	// UpdateReady is called when the new binary is handed out.
+	UpdateReady(latest Info)
+}
+
+// NopEventHandler is an EventHandler which ignores all the events.
+type NopEventHandler struct{}
+
+func (NopEventHandler) CheckStarted()                         {}
+func (NopEventHandler) NoUpdate(Info)                         {}
+func (NopEventHandler) UpdateFound(Info)                      {}
+func (NopEventHandler) DownloadProgress(string, int64, int64) {}
+func (NopEventHandler) PatchApplied(string)                   {}
+func (NopEventHandler) FallbackToFull(error)                  {}
+func (NopEventHandler) VerificationFailed(string, error)      {}
+func (NopEventHandler) UpdateReady(Info)                      {}
+
+var _ EventHandler = NopEventHandler{}
+
+// events returns h.Events, or a NopEventHandler if it is nil.
+func (h *HTTPSelfUpdate) events() EventHandler {
+	if h.Events == nil {
+		return NopEventHandler{}
+	}
+	return h.Events
+}
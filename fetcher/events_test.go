@@ -0,0 +1,176 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/pkg/errors"
+)
+
+type recordingHandler struct {
+	NopEventHandler
+	events []string
+}
+
+func (r *recordingHandler) add(format string, args ...interface{}) {
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+func (r *recordingHandler) CheckStarted()         { r.add("started") }
+func (r *recordingHandler) NoUpdate(Info)         { r.add("none") }
+func (r *recordingHandler) UpdateFound(Info)      { r.add("found") }
+func (r *recordingHandler) FallbackToFull(error)  { r.add("fallback") }
+func (r *recordingHandler) UpdateReady(Info)      { r.add("ready") }
+func (r *recordingHandler) PatchApplied(m string) { r.add("patched %s", m) }
+func (r *recordingHandler) VerificationFailed(m string, err error) {
+	r.add("failed %s", m)
+}
+func (r *recordingHandler) DownloadProgress(URL string, read, total int64) {
+	if read == total {
+		r.add("progress %s %d/%d", URL[strings.LastIndexByte(URL, '/')+1:], read, total)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	Logf = t.Logf
+	self = os.Args[0]
+	fh, err := os.Open(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := GetSha(fh)
+	fh.Close()
+
+	bin := gzipped("new")
+	info := Info{Sha256: GetSha(strings.NewReader("new"))}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/info.json":
+			json.NewEncoder(w).Encode(info)
+		case "/bin.gz":
+			w.Write(bin)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	var events recordingHandler
+	h := HTTPSelfUpdate{URL: srv.URL, Events: &events}
+	if err := h.Templates.Init("info.json", "diff/{{.OldSha}}", "bin.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := h.FetchContext(context.Background()); err != nil || r == nil {
+		t.Fatalf("got %v (%v), awaited the update", r, err)
+	}
+	want := fmt.Sprintf("started found fallback progress bin.gz %d/%d ready", len(bin), len(bin))
+	if got := strings.Join(events.events, " "); got != want {
+		t.Errorf("got %q, awaited %q", got, want)
+	}
+
+	events.events, h.delay, info.Sha256 = nil, false, cur
+	if r, err := h.FetchContext(context.Background()); err != nil || r != nil {
+		t.Fatalf("got %v (%v), awaited no update", r, err)
+	}
+	if got := strings.Join(events.events, " "); got != "started none" {
+		t.Errorf("got %q, awaited %q", got, "started none")
+	}
+}
+
+func TestEventsVerificationFailed(t *testing.T) {
+	Logf = t.Logf
+	defer withSelf(t, "old")()
+
+	idx := ChunkIndex{Sha256: GetSha(strings.NewReader("new"))}
+	if err := SplitChunks(strings.NewReader("new"), func(c Chunk, _ []byte) error {
+		idx.Chunks = append(idx.Chunks, c)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	idxJSON, err := json.Marshal(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infoJSON, err := json.Marshal(Info{Sha256: idx.Sha256, Chunked: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sig bytes.Buffer
+	if err = openpgp.ArmoredDetachSign(&sig, SignerKey(testKeyring), strings.NewReader("tampered"), nil); err != nil {
+		t.Fatal(err)
+	}
+	bin := gzipped("new")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/info.json":
+			w.Write(infoJSON)
+		case r.URL.Path == "/info.json.asc":
+			w.Write(sig.Bytes())
+		case r.URL.Path == "/index.json":
+			w.Write(idxJSON)
+		case strings.HasPrefix(r.URL.Path, "/chunks/"):
+			w.Write(gzipped("corrupt"))
+		case r.URL.Path == "/bin.gz":
+			w.Write(bin)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	var events recordingHandler
+	h := HTTPSelfUpdate{URL: srv.URL, Events: &events}
+	if err = h.Templates.Init("info.json", "diff/{{.OldSha}}", "bin.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Templates.InitChunks("index.json", "chunks/{{.ChunkSha}}"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if b, err := h.fetchUpdate(ctx); err != nil || string(b) != "new" {
+		t.Fatalf("got %q (%v), awaited the full binary", b, err)
+	}
+	want := fmt.Sprintf("started found failed chunks fallback progress bin.gz %d/%d", len(bin), len(bin))
+	if got := strings.Join(events.events, " "); got != want {
+		t.Errorf("corrupt chunk: got %q, awaited %q", got, want)
+	}
+
+	events.events, h.Keyring = nil, testKeyring
+	if _, err := h.fetchUpdate(ctx); errors.Cause(err) != ErrBadSignature {
+		t.Errorf("got %v, awaited %v", err, ErrBadSignature)
+	}
+	if got, want := strings.Join(events.events, " "), "started failed info"; got != want {
+		t.Errorf("bad signature: got %q, awaited %q", got, want)
+	}
+}
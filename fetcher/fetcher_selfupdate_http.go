@@ -30,7 +30,6 @@ package fetcher
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
@@ -50,18 +49,26 @@ import (
 	"golang.org/x/crypto/openpgp"
 
 	"github.com/kardianos/osext"
-	"github.com/kr/binarydist"
 	"github.com/pkg/errors"
 )
 
 const (
 	DefaultInfoPath = "{{.GOOS}}_{{.GOARCH}}.json"
 	DefaultDiffPath = "{{.GOOS}}_{{.GOARCH}}/{{.OldSha}}/{{.NewSha}}{{if .IsEncrypted}}.gpg{{end}}"
-	DefaultBinPath  = "{{.GOOS}}_{{.GOARCH}}/{{.NewSha}}.gz{{if .IsEncrypted}}.gpg{{end}}"
+	DefaultBinPath  = "{{.GOOS}}_{{.GOARCH}}/{{.NewSha}}{{.CompressionExt}}{{if .IsEncrypted}}.gpg{{end}}"
+
+	DefaultIndexPath = "{{.GOOS}}_{{.GOARCH}}/index/{{.NewSha}}.json"
+	DefaultChunkPath = "{{.GOOS}}_{{.GOARCH}}/chunks/{{.ChunkSha}}.gz{{if .IsEncrypted}}.gpg{{end}}"
+
+	DefaultRawPath   = "{{.GOOS}}_{{.GOARCH}}/raw/{{.NewSha}}"
+	DefaultZsyncPath = "{{.GOOS}}_{{.GOARCH}}/zsync/{{.NewSha}}.json"
 
 	DefaultFetchInfoTimeout  = 10 * time.Second
 	DefaultFetchPatchTimeout = 1 * time.Minute
 	DefaultFetchBinTimeout   = 10 * time.Minute
+
+	// DefaultCriticalRetry is the wait instead of Interval after a failed critical update.
+	DefaultCriticalRetry = 30 * time.Second
 )
 
 var (
@@ -92,11 +99,21 @@ func logf(pattern string, args ...interface{}) {
 // Then tries the diffs from <URL>/<DiffPath>
 // for example http://example.com/mybin/linux-amd64/aaa/bbb
 //
+// If the info says the binary is chunked, then retrieves the chunk index from
+// <URL>/<IndexPath>, and assembles the new binary from the chunks of the running
+// executable and the missing chunks downloaded from <URL>/<ChunkPath>.
+//
+// If the info says zsync is published, then retrieves the block checksums from
+// <URL>/<ZsyncPath>, and downloads only the blocks missing from the running
+// executable, with HTTP Range requests from the uncompressed <URL>/<RawPath>.
+//
 // Then retrieves the full binary from <URL>/<BinPath>
 // for example http://example.com/mybin/linux-amd64/bbb.gz
 //
-// InfoPath, DiffPath and BinPath are treated as text/template templates.
-// Usable fields: GOOS, GOARCH, OldSha, NewSha, BinaryName, IsEncrypted.
+// InfoPath, DiffPath, BinPath, IndexPath, ChunkPath, RawPath and ZsyncPath
+// are treated as text/template templates.
+// Usable fields: GOOS, GOARCH, OldSha, NewSha, ChunkSha, BinaryName, IsEncrypted,
+// Compression and CompressionExt.
 //
 // URLs starting with "file://" are treated as file path, and opened directly with os.Open - mainly for testing.
 type HTTPSelfUpdate struct {
@@ -113,17 +130,108 @@ type HTTPSelfUpdate struct {
 
 	Keyring openpgp.KeyRing // for decrypting encrypted binary
 
+	// Windows are the maintenance windows: if set, an update is downloaded
+	// when found, but returned by FetchContext only within one of these
+	// (in Location, or local time if nil), unless it is critical.
+	Windows  []Window
+	Location *time.Location
+
+	// HealthTimeout enables the health check of the updates, if not zero:
+	// an update not confirmed with ConfirmHealthy within HealthTimeout
+	// is rolled back to the previous binary, and blacklisted.
+	HealthTimeout time.Duration
+
+	// Events receives the events of the update lifecycle, if not nil.
+	Events EventHandler
+
+	// OnProgress is called with the bytes read of a diff or full binary
+	// download from URL, and its total size (-1 if unknown), at most once
+	// in ProgressInterval (DefaultProgressInterval if zero), and at the end.
+	OnProgress       func(URL string, read, total int64)
+	ProgressInterval time.Duration
+
+	IndexPath string // template for the chunk index path, defaults to DefaultIndexPath
+	ChunkPath string // template for the chunk path, defaults to DefaultChunkPath
+	RawPath   string // template for the uncompressed binary path, defaults to DefaultRawPath
+	ZsyncPath string // template for the zsync control path, defaults to DefaultZsyncPath
+
 	//interal state
 	delay     bool
+	urgent    bool           // a critical update is pending
+	pending   *pendingBinary // downloaded, waiting for a maintenance window
+	checkNow  chan struct{}
 	lasts     map[string]string
 	Templates Templates
 }
 type Info struct {
-	Sha256 []byte // sha256 of the latest version
+	Sha256     []byte     // sha256 of the latest version
+	Build      *BuildInfo `json:",omitempty"` // Go build info of the latest version
+	DiffFormat string     `json:",omitempty"` // format of the diffs, defaults to DiffBsdiff
+	Chunked    bool       `json:",omitempty"` // the chunk index and the chunks are published
+	Zsync      bool       `json:",omitempty"` // the zsync control and the raw binary are published
+	// Compression of the full binary, defaults to CompressGzip
+	Compression string `json:",omitempty"`
+	// BinSize is the size of the published full binary file
+	BinSize int64 `json:",omitempty"`
+	// Revoked lists the sha256 of the pulled releases, which must not be installed
+	Revoked [][]byte `json:",omitempty"`
+	// Critical updates are installed as soon as possible
+	Critical bool `json:",omitempty"`
+	// History lists the sha256 of the releases, from the oldest to the latest
+	History [][]byte `json:",omitempty"`
+	// MinSha256 is the sha256 of the oldest supported release
+	MinSha256 []byte `json:",omitempty"`
+	// Replacement is the release to install instead of the latest one, if that is revoked
+	Replacement *Info `json:",omitempty"`
+}
+
+// BelowMinimum reports whether the release with the given sha256 is older
+// than MinSha256; releases not in the History are treated as older.
+func (info Info) BelowMinimum(sha []byte) bool {
+	if len(info.MinSha256) == 0 || bytes.Equal(sha, info.Sha256) || bytes.Equal(sha, info.MinSha256) {
+		return false
+	}
+	iMin, iSha := -1, -1
+	for i, h := range info.History {
+		if bytes.Equal(h, info.MinSha256) {
+			iMin = i
+		}
+		if bytes.Equal(h, sha) {
+			iSha = i
+		}
+	}
+	return iSha < 0 || iSha < iMin
+}
+
+// IsRevoked reports whether the release with the given sha256 has been pulled.
+func (info Info) IsRevoked(sha []byte) bool {
+	for _, r := range info.Revoked {
+		if bytes.Equal(r, sha) {
+			return true
+		}
+	}
+	return false
+}
+
+// Target returns the release to install: the latest one, or the Replacement
+// of it if it is revoked. ok is false if there's no release to install.
+func (info Info) Target() (target Info, ok bool) {
+	if !info.IsRevoked(info.Sha256) {
+		return info, true
+	}
+	if info.Replacement == nil || info.IsRevoked(info.Replacement.Sha256) {
+		return info, false
+	}
+	target = *info.Replacement
+	target.Revoked, target.History, target.MinSha256 = info.Revoked, info.History, info.MinSha256
+	target.Replacement = nil
+	return target, true
 }
 
 type Templates struct {
 	Info, Diff, Bin *template.Template
+	Index, Chunk    *template.Template
+	Raw, Zsync      *template.Template
 }
 
 func (t *Templates) Init(info, diff, bin string) error {
@@ -146,6 +254,45 @@ func (t *Templates) Init(info, diff, bin string) error {
 	if t.Bin, err = template.New("bin").Parse(bin); err != nil {
 		return errors.Wrapf(err, "parse bin template %q", bin)
 	}
+	if err = t.InitChunks("", ""); err != nil {
+		return err
+	}
+	return t.InitZsync("", "")
+}
+
+// InitChunks initializes the chunk index and chunk templates.
+func (t *Templates) InitChunks(index, chunk string) error {
+	if index == "" {
+		index = DefaultIndexPath
+	}
+	var err error
+	if t.Index, err = template.New("index").Parse(index); err != nil {
+		return errors.Wrapf(err, "parse index template %q", index)
+	}
+	if chunk == "" {
+		chunk = DefaultChunkPath
+	}
+	if t.Chunk, err = template.New("chunk").Parse(chunk); err != nil {
+		return errors.Wrapf(err, "parse chunk template %q", chunk)
+	}
+	return nil
+}
+
+// InitZsync initializes the raw binary and zsync control templates.
+func (t *Templates) InitZsync(raw, zsync string) error {
+	if raw == "" {
+		raw = DefaultRawPath
+	}
+	var err error
+	if t.Raw, err = template.New("raw").Parse(raw); err != nil {
+		return errors.Wrapf(err, "parse raw template %q", raw)
+	}
+	if zsync == "" {
+		zsync = DefaultZsyncPath
+	}
+	if t.Zsync, err = template.New("zsync").Parse(zsync); err != nil {
+		return errors.Wrapf(err, "parse zsync template %q", zsync)
+	}
 	return nil
 }
 
@@ -161,15 +308,22 @@ var self string
 
 type URLInfo struct {
 	Platform
-	OldSha, NewSha, BinaryName string
-	IsEncrypted                bool
+	OldSha, NewSha, ChunkSha, BinaryName string
+	Compression                          string
+	IsEncrypted                          bool
 }
 
+// CompressionExt returns the file name extension of the full binary's compression.
+func (u URLInfo) CompressionExt() string { return CompressionExt(u.Compression) }
+
 // Init initializes the templates and returns any error met.
 func (h *HTTPSelfUpdate) Init() error {
 	if h.Interval == 0 {
 		h.Interval = 5 * time.Minute
 	}
+	if h.checkNow == nil {
+		h.checkNow = make(chan struct{}, 1)
+	}
 
 	var err error
 	self, err = osext.Executable()
@@ -177,7 +331,30 @@ func (h *HTTPSelfUpdate) Init() error {
 		return errors.Wrapf(err, "find self executable")
 	}
 
-	return h.Templates.Init(h.InfoPath, h.DiffPath, h.BinPath)
+	if err = h.Templates.Init(h.InfoPath, h.DiffPath, h.BinPath); err != nil {
+		return err
+	}
+	if err = h.Templates.InitChunks(h.IndexPath, h.ChunkPath); err != nil {
+		return err
+	}
+	return h.Templates.InitZsync(h.RawPath, h.ZsyncPath)
+}
+
+// BelowMinimum reports whether the running binary is older than the minimum
+// supported release, according to the last fetched Info.
+func (h *HTTPSelfUpdate) BelowMinimum() (bool, error) {
+	cur, err := fileSha(self)
+	if err != nil {
+		return false, err
+	}
+	return h.Info.BelowMinimum(cur), nil
+}
+
+// CurrentBuild returns the Go build info of the running binary, or nil.
+//
+// The build info of the latest version is in Info.Build.
+func (h *HTTPSelfUpdate) CurrentBuild() *BuildInfo {
+	return CurrentBuildInfo()
 }
 
 func (_ Templates) Execute(tpl *template.Template, info URLInfo) (string, error) {
@@ -188,13 +365,87 @@ func (_ Templates) Execute(tpl *template.Template, info URLInfo) (string, error)
 	return buf.String(), nil
 }
 
+// Fetch is FetchContext with context.Background, for overseer.Fetcher.
 func (h *HTTPSelfUpdate) Fetch() (io.Reader, error) {
+	return h.FetchContext(context.Background())
+}
+
+// FetchContext waits Interval (except for the first call), then fetches
+// the info, and the new binary if it differs from the running one.
+//
+// Cancelling ctx interrupts the wait and the downloads, and returns ctx.Err().
+// CheckNow ends the wait immediately.
+func (h *HTTPSelfUpdate) FetchContext(ctx context.Context) (io.Reader, error) {
 	//delay fetches after first
 	if h.delay {
-		logf("sleep %s", h.Interval)
-		time.Sleep(h.Interval)
+		interval := h.Interval
+		if h.urgent && DefaultCriticalRetry < interval {
+			interval = DefaultCriticalRetry
+		}
+		if d := h.healthDeadline(); d > 0 && d < interval {
+			interval = d
+		}
+		if h.pending != nil {
+			if d := h.untilWindow(time.Now()); d < interval {
+				interval = d
+			}
+		}
+		logf("sleep %s", interval)
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-h.checkNow:
+			t.Stop()
+			logf("check requested")
+		case <-t.C:
+		}
 	}
 	h.delay = true
+	bin, err := h.nextUpdate(ctx, true, true)
+	if err != nil || bin == nil {
+		return nil, err
+	}
+	return bytes.NewReader(bin), nil
+}
+
+// nextUpdate returns the binary to be installed next, if any:
+// the previous one if the running one failed the health check,
+// or the new one - only in a maintenance window if inWindow is set,
+// else it is kept for later.
+//
+// With backup, the running binary is saved for the health check's rollback,
+// when the new one is handed out; without, the caller must (as Apply does).
+func (h *HTTPSelfUpdate) nextUpdate(ctx context.Context, inWindow, backup bool) ([]byte, error) {
+	if h.HealthTimeout > 0 {
+		if prev, err := h.checkHealth(); err != nil {
+			logf("health check: %+v", err)
+		} else if prev != nil {
+			return prev, nil
+		}
+	}
+	bin, err := h.fetchUpdate(ctx)
+	if err != nil || bin == nil {
+		return nil, err
+	}
+	if inWindow && !h.urgent && !h.InWindow(time.Now()) {
+		logf("keeping %s till the maintenance window", EncodeSha(h.Info.Sha256))
+		h.pending = &pendingBinary{Sha256: h.Info.Sha256, bin: bin}
+		return nil, nil
+	}
+	h.pending, h.urgent = nil, false
+	if h.HealthTimeout > 0 {
+		if err := markPending(h.Info.Sha256, backup); err != nil {
+			logf("mark pending update: %+v", err)
+		}
+	}
+	h.events().UpdateReady(h.Info)
+	return bin, nil
+}
+
+// fetchUpdate fetches the info, and the new binary if it differs from the running one.
+func (h *HTTPSelfUpdate) fetchUpdate(ctx context.Context) ([]byte, error) {
 
 	var old io.ReadSeeker
 	fh, err := os.Open(self)
@@ -206,7 +457,11 @@ func (h *HTTPSelfUpdate) Fetch() (io.Reader, error) {
 	}
 
 	// fetch info
-	if err = h.fetchInfo(); err != nil {
+	h.events().CheckStarted()
+	if err = h.fetchInfo(ctx); err != nil {
+		if errors.Cause(err) == ErrBadSignature {
+			h.events().VerificationFailed(MethodInfo, err)
+		}
 		return nil, err
 	}
 
@@ -215,67 +470,181 @@ func (h *HTTPSelfUpdate) Fetch() (io.Reader, error) {
 		return nil, errors.Wrapf(err, "read binary %q", fh.Name())
 	}
 	oldSha := hsh.Sum(nil)
+	target, ok := h.Info.Target()
+	if !ok {
+		logf("the latest release %s is revoked, staying", EncodeSha(h.Info.Sha256))
+		h.events().NoUpdate(h.Info)
+		return nil, nil
+	}
+	if !bytes.Equal(target.Sha256, h.Info.Sha256) {
+		logf("the latest release %s is revoked, its replacement is %s",
+			EncodeSha(h.Info.Sha256), EncodeSha(target.Sha256))
+		h.Info = target
+	}
 	if bytes.Equal(oldSha, h.Info.Sha256) {
+		h.events().NoUpdate(h.Info)
 		return nil, nil
 	}
+	revoked := h.Info.IsRevoked(oldSha)
+	if revoked {
+		logf("the running release %s is revoked", EncodeSha(oldSha))
+	}
+	if IsBlacklisted(h.Info.Sha256) {
+		logf("%s is blacklisted, as it failed the health check", EncodeSha(h.Info.Sha256))
+		h.events().NoUpdate(h.Info)
+		return nil, nil
+	}
+	if h.urgent = revoked || h.Info.Critical || h.Info.BelowMinimum(oldSha); h.urgent {
+		logf("the update to %s is critical", EncodeSha(h.Info.Sha256))
+	}
+	if h.pending != nil {
+		if bytes.Equal(h.pending.Sha256, h.Info.Sha256) {
+			logf("using the already downloaded %s", EncodeSha(h.Info.Sha256))
+			return h.pending.bin, nil
+		}
+		h.pending = nil
+	}
 	if _, err := fh.Seek(0, 0); err != nil {
 		return nil, errors.Wrapf(err, "seek back to the beginning of %q", fh.Name())
 	}
+	logf("updating from %s to %s", h.CurrentBuild(), h.Info.Build)
+	h.events().UpdateFound(h.Info)
 
 	var bin []byte
+	var patchErr error
+	failed := func(method string, err error) {
+		switch errors.Cause(err) {
+		case ErrHashMismatch, ErrBadSignature:
+			logf("update: verifying %s: %+v", method, err)
+			h.events().VerificationFailed(method, err)
+		default:
+			logf("update: fetching %s: %+v", method, err)
+		}
+		patchErr = err
+	}
 	if old != nil {
-		if bin, err = h.fetchAndVerifyPatch(old, oldSha); err != nil {
+		if bin, err = h.fetchAndVerifyPatch(ctx, old, oldSha); err != nil {
 			bin = nil
-			if err == ErrHashMismatch {
-				logf("update: hash mismatch from patched binary")
-			} else {
-				logf("update: fetching patch: %+v", err)
-			}
+			failed(MethodDiff, err)
+		} else {
+			h.events().PatchApplied(MethodDiff)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if bin == nil && old != nil && h.Info.Chunked {
+		if _, err = old.Seek(0, 0); err != nil {
+			return nil, errors.Wrapf(err, "seek back to the beginning of %q", fh.Name())
+		}
+		if bin, err = h.fetchAndVerifyChunks(ctx, old); err == nil && !verifySha(bin, h.Info.Sha256) {
+			err = ErrHashMismatch
+		}
+		if err != nil {
+			bin = nil
+			failed(MethodChunks, err)
+		} else {
+			h.events().PatchApplied(MethodChunks)
 		}
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if bin == nil && old != nil && h.Info.Zsync {
+		if _, err = old.Seek(0, 0); err != nil {
+			return nil, errors.Wrapf(err, "seek back to the beginning of %q", fh.Name())
+		}
+		if bin, err = h.fetchAndVerifyZsync(ctx, old); err == nil && !verifySha(bin, h.Info.Sha256) {
+			err = ErrHashMismatch
+		}
+		if err != nil {
+			bin = nil
+			failed(MethodZsync, err)
+		} else {
+			h.events().PatchApplied(MethodZsync)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if bin == nil {
-		if bin, err = h.fetchAndVerifyFullBin(); err != nil {
-			if err == ErrHashMismatch {
-				logf("update: hash mismatch from full binary")
-			} else {
-				logf("update: fetching full binary: %+v", err)
-			}
+		if patchErr != nil {
+			h.events().FallbackToFull(patchErr)
+		}
+		if bin, err = h.fetchAndVerifyFullBin(ctx); err != nil {
+			failed(MethodFull, err)
 			return nil, err
 		}
 	}
 
 	//success!
 	logf("success, binary length=%d", len(bin))
-	return bytes.NewReader(bin), nil
+	return bin, nil
 }
 
 func fetch(ctx context.Context, URL string, keyring openpgp.KeyRing) (io.ReadCloser, error) {
+	body, _, err := get(ctx, URL)
+	if err != nil {
+		return nil, err
+	}
+	return readMessage(URL, body, keyring)
+}
+
+// fetchProgress is fetch, reporting the progress of the download to OnProgress
+// and Events. size is the awaited size (-1 if unknown), used when the response
+// has no Content-Length.
+func (h *HTTPSelfUpdate) fetchProgress(ctx context.Context, URL string, keyring openpgp.KeyRing, size int64) (io.ReadCloser, error) {
+	body, length, err := get(ctx, URL)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		length = size
+	}
+	return readMessage(URL, h.newProgressReader(URL, body, length), keyring)
+}
+
+// get returns the body of URL, and its length (-1 if unknown).
+func get(ctx context.Context, URL string) (io.ReadCloser, int64, error) {
 	logf("fetch %q", URL)
 	if strings.HasPrefix(URL, "file://") { // great for testing
-		return os.Open(URL[7:])
+		fh, err := os.Open(URL[7:])
+		if err != nil {
+			return nil, -1, err
+		}
+		var length int64 = -1
+		if fi, err := fh.Stat(); err == nil {
+			length = fi.Size()
+		}
+		return fh, length, nil
 	}
 	req, err := http.NewRequest("GET", URL, nil)
 	if err != nil {
-		return nil, errors.Wrapf(err, "NewRequest(%q)", URL)
+		return nil, -1, errors.Wrapf(err, "NewRequest(%q)", URL)
 	}
 	req = req.WithContext(ctx)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		logf("fetch %q: %+v", URL, err)
-		return nil, errors.Wrapf(err, "GET %q", URL)
+		return nil, -1, errors.Wrapf(err, "GET %q", URL)
 	}
 	if resp.StatusCode != http.StatusOK {
 		resp.Body.Close()
 		logf("fetch %q: %v", URL, resp.StatusCode)
-		return nil, errors.New(fmt.Sprintf("GET failed for %q: %d", URL, resp.StatusCode))
+		return nil, -1, errors.New(fmt.Sprintf("GET failed for %q: %d", URL, resp.StatusCode))
 	}
 	logf("fetched %q: %v", URL, resp.StatusCode)
+	return resp.Body, resp.ContentLength, nil
+}
+
+// readMessage decrypts body with keyring, if it has keys.
+func readMessage(URL string, body io.ReadCloser, keyring openpgp.KeyRing) (io.ReadCloser, error) {
 	if !HasKeys(keyring) {
-		return resp.Body, nil
+		return body, nil
 	}
-	md, err := openpgp.ReadMessage(resp.Body, keyring, KeyPrompt, nil)
+	md, err := openpgp.ReadMessage(body, keyring, KeyPrompt, nil)
 	if err != nil {
-		resp.Body.Close()
+		body.Close()
 		logf("read %q with keyring %v: %+v", URL, keyring, err)
 		return nil, errors.Wrapf(err, "read pgp message with %v", keyring)
 	}
@@ -286,11 +655,17 @@ func fetch(ctx context.Context, URL string, keyring openpgp.KeyRing) (io.ReadClo
 		io.Closer
 	}{
 		io.MultiReader(bytes.NewReader(part[:n]), md.UnverifiedBody),
-		resp.Body,
+		body,
 	}, errors.Wrapf(err, "read UnverifiedBody with %v", keyring)
 }
 
-func (h HTTPSelfUpdate) getPath(which string, oldSha, newSha []byte) (string, error) {
+func (h *HTTPSelfUpdate) getPath(which string, oldSha, newSha []byte) (string, error) {
+	return h.pathOf(which, h.Info, oldSha, newSha)
+}
+
+// pathOf returns the path of the given kind of file of the release described by info.
+// It only reads the configuration of h, not its state.
+func (h *HTTPSelfUpdate) pathOf(which string, info Info, oldSha, newSha []byte) (string, error) {
 	var tpl *template.Template
 	switch which {
 	case "info":
@@ -299,9 +674,31 @@ func (h HTTPSelfUpdate) getPath(which string, oldSha, newSha []byte) (string, er
 		tpl = h.Templates.Diff
 	case "bin":
 		tpl = h.Templates.Bin
+	case "index":
+		tpl = h.Templates.Index
+	case "raw":
+		tpl = h.Templates.Raw
+	case "zsync":
+		tpl = h.Templates.Zsync
 	default:
 		return "", errors.New("unknown template " + which)
 	}
+	ui := h.urlInfoOf(info, oldSha, newSha)
+	path, err := h.Templates.Execute(tpl, ui)
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		return "", errors.New(fmt.Sprintf("empty path from %v", ui))
+	}
+	return path, nil
+}
+
+func (h *HTTPSelfUpdate) urlInfo(oldSha, newSha []byte) URLInfo {
+	return h.urlInfoOf(h.Info, oldSha, newSha)
+}
+
+func (h *HTTPSelfUpdate) urlInfoOf(info Info, oldSha, newSha []byte) URLInfo {
 	var oldShaS, newShaS string
 	if len(oldSha) > 0 {
 		oldShaS = EncodeSha(oldSha)
@@ -309,72 +706,56 @@ func (h HTTPSelfUpdate) getPath(which string, oldSha, newSha []byte) (string, er
 	if len(newSha) > 0 {
 		newShaS = EncodeSha(newSha)
 	}
-	ui := URLInfo{
+	return URLInfo{
 		Platform:    thePlatform,
 		OldSha:      oldShaS,
 		NewSha:      newShaS,
 		BinaryName:  filepath.Base(self),
+		Compression: info.Compression,
 		IsEncrypted: HasKeys(h.Keyring),
 	}
-	path, err := h.Templates.Execute(tpl, ui)
+}
+
+func (h *HTTPSelfUpdate) fetchInfo(ctx context.Context) error {
+	info, err := h.readInfo(ctx)
 	if err != nil {
-		return "", err
-	}
-	if path == "" {
-		return "", errors.New(fmt.Sprintf("empty path from %v", ui))
+		return err
 	}
-	return path, nil
+	h.Info = info
+	h.urgent = false
+	logf("Upstream hash is %q.", EncodeSha(h.Info.Sha256))
+	return nil
 }
 
-func (h *HTTPSelfUpdate) fetchInfo() error {
-	path, err := h.getPath("info", nil, nil)
+// readInfo fetches and returns the info of the latest version.
+func (h *HTTPSelfUpdate) readInfo(ctx context.Context) (Info, error) {
+	var info Info
+	path, err := h.pathOf("info", Info{}, nil, nil)
 	if err != nil {
-		return errors.Wrapf(err, "get info path")
+		return info, errors.Wrapf(err, "get info path")
 	}
-	ctx, cancel := getTimeoutCtx(context.Background(), h.FetchInfoTimeout, DefaultFetchInfoTimeout)
+	ctx, cancel := getTimeoutCtx(ctx, h.FetchInfoTimeout, DefaultFetchInfoTimeout)
 	defer cancel()
-	r, err := fetch(ctx, h.URL+"/"+path, nil)
+	b, err := h.fetchSigned(ctx, h.URL+"/"+path)
 	if err != nil {
-		return err
-	}
-	b, err := ioutil.ReadAll(r)
-	r.Close()
-	if err != nil {
-		return err
-	}
-
-	if HasKeys(h.Keyring) {
-		r, err := fetch(ctx, h.URL+"/"+path+".asc", nil)
-		if err != nil {
-			return err
-		}
-		_, err = openpgp.CheckArmoredDetachedSignature(h.Keyring, bytes.NewReader(b), r)
-		r.Close()
-		if err != nil {
-			for _, e := range h.Keyring.(openpgp.EntityList) {
-				logf("%q", e.Identities)
-			}
-			return errors.Wrapf(err, "check %q with %q", b, h.Keyring)
-		}
+		return info, err
 	}
-	err = json.NewDecoder(bytes.NewReader(b)).Decode(&h.Info)
-	if err != nil {
-		return errors.Wrapf(err, "decode %q", b)
+	if err = json.NewDecoder(bytes.NewReader(b)).Decode(&info); err != nil {
+		return info, errors.Wrapf(err, "decode %q", b)
 	}
-	if len(h.Info.Sha256) != sha256.Size {
-		return errors.New("bad cmd hash in info")
+	if len(info.Sha256) != sha256.Size {
+		return info, errors.New("bad cmd hash in info")
 	}
-	logf("Upstream hash is %q.", EncodeSha(h.Info.Sha256))
-	return nil
+	return info, nil
 }
 
 var ErrHashMismatch = errors.New("hash mismatch")
 
-func (h *HTTPSelfUpdate) fetchAndVerifyPatch(old io.ReadSeeker, oldSha []byte) ([]byte, error) {
+func (h *HTTPSelfUpdate) fetchAndVerifyPatch(ctx context.Context, old io.ReadSeeker, oldSha []byte) ([]byte, error) {
 	if old == nil {
 		return nil, errors.New("empty old")
 	}
-	bin, err := h.fetchAndApplyPatch(old, oldSha)
+	bin, err := h.fetchAndApplyPatch(ctx, old, oldSha)
 	if err != nil {
 		return nil, err
 	}
@@ -384,31 +765,41 @@ func (h *HTTPSelfUpdate) fetchAndVerifyPatch(old io.ReadSeeker, oldSha []byte) (
 	return bin, nil
 }
 
-func (h *HTTPSelfUpdate) fetchAndApplyPatch(old io.ReadSeeker, oldSha []byte) ([]byte, error) {
+func (h *HTTPSelfUpdate) fetchAndApplyPatch(ctx context.Context, old io.ReadSeeker, oldSha []byte) ([]byte, error) {
 	if len(oldSha) != sha256.Size {
 		oldSha = GetSha(old)
 		if _, err := old.Seek(0, 0); err != nil {
 			return nil, err
 		}
 	}
+	format, err := GetDiffFormat(h.Info.DiffFormat)
+	if err != nil {
+		return nil, err
+	}
 	path, err := h.getPath("diff", oldSha, h.Info.Sha256)
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := getTimeoutCtx(context.Background(), h.FetchPatchTimeout, DefaultFetchPatchTimeout)
+	ctx, cancel := getTimeoutCtx(ctx, h.FetchPatchTimeout, DefaultFetchPatchTimeout)
 	defer cancel()
-	r, err := fetch(ctx, h.URL+"/"+path, h.Keyring)
+	r, err := h.fetchProgress(ctx, h.URL+"/"+path, h.Keyring, -1)
 	if err != nil {
 		return nil, errors.WithMessage(err, "fetchAndVerifyPatch")
 	}
 	defer r.Close()
+	// the diff may be compressed, as generate found it smaller
+	dr, err := NewSniffingDecompressor(r)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
 	var buf bytes.Buffer
-	err = binarydist.Patch(old, &buf, r)
+	err = format.Patch(old, &buf, dr)
 	return buf.Bytes(), errors.Wrap(err, "apply patch")
 }
 
-func (h *HTTPSelfUpdate) fetchAndVerifyFullBin() ([]byte, error) {
-	bin, err := h.fetchBin()
+func (h *HTTPSelfUpdate) fetchAndVerifyFullBin(ctx context.Context) ([]byte, error) {
+	bin, err := h.fetchBin(ctx)
 	if err != nil {
 		return nil, errors.WithMessage(err, "fetchAndVerifyFullBin")
 	}
@@ -419,24 +810,29 @@ func (h *HTTPSelfUpdate) fetchAndVerifyFullBin() ([]byte, error) {
 	return bin, nil
 }
 
-func (h *HTTPSelfUpdate) fetchBin() ([]byte, error) {
+func (h *HTTPSelfUpdate) fetchBin(ctx context.Context) ([]byte, error) {
 	path, err := h.getPath("bin", nil, h.Info.Sha256)
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := getTimeoutCtx(context.Background(), h.FetchBinTimeout, DefaultFetchBinTimeout)
+	ctx, cancel := getTimeoutCtx(ctx, h.FetchBinTimeout, DefaultFetchBinTimeout)
 	defer cancel()
-	r, err := fetch(ctx, h.URL+"/"+path, h.Keyring)
+	size := h.Info.BinSize
+	if size <= 0 {
+		size = -1
+	}
+	r, err := h.fetchProgress(ctx, h.URL+"/"+path, h.Keyring, size)
 	if err != nil {
 		return nil, errors.WithMessage(err, "fetchBin")
 	}
 	defer r.Close()
-	gz, err := gzip.NewReader(r)
+	dr, err := NewDecompressor(h.Info.Compression, r)
 	if err != nil {
-		return nil, errors.Wrap(err, "gzip")
+		return nil, err
 	}
-	b, err := ioutil.ReadAll(gz)
-	return b, errors.Wrap(err, "read gzip")
+	defer dr.Close()
+	b, err := ioutil.ReadAll(dr)
+	return b, errors.Wrapf(err, "read %q", path)
 }
 
 func NewSha() hash.Hash {
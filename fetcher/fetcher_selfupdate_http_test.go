@@ -24,15 +24,21 @@ package fetcher
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/openpgp"
+
+	"github.com/pkg/errors"
 )
 
 func TestTemplates(t *testing.T) {
@@ -82,11 +88,76 @@ func TestFetchInfo(t *testing.T) {
 	}
 	su.Init()
 
-	if err := su.fetchInfo(); err != nil {
+	if err := su.fetchInfo(context.Background()); err != nil {
 		t.Errorf("%+v", err)
 	}
 }
 
+func TestFetchSignedMessage(t *testing.T) {
+	Logf = t.Logf
+	info := []byte(`{"Sha256":"` + base64.StdEncoding.EncodeToString(GetSha(strings.NewReader("new"))) + `"}`)
+	other, err := openpgp.NewEntity("Other", "", "other-producer@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var good, forged bytes.Buffer
+	if err = WriteSigned(&good, info, testKeyring); err != nil {
+		t.Fatal(err)
+	}
+	if err = WriteSigned(&forged, info, openpgp.EntityList{other}); err != nil {
+		t.Fatal(err)
+	}
+	signed, asc := good.Bytes(), 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/info.json":
+			w.Write(signed)
+		case "/info.json.asc":
+			asc++
+			http.NotFound(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	su := &HTTPSelfUpdate{URL: server.URL, InfoPath: "info.json", Keyring: testKeyring}
+	su.Init()
+
+	if err := su.fetchInfo(context.Background()); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(su.Info.Sha256, GetSha(strings.NewReader("new"))) {
+		t.Errorf("got %+v", su.Info)
+	}
+	if asc != 0 {
+		t.Errorf("got %d detached signature requests for a signed message", asc)
+	}
+
+	signed = forged.Bytes()
+	if err := su.fetchInfo(context.Background()); errors.Cause(err) != ErrBadSignature {
+		t.Errorf("got %v, awaited %v", err, ErrBadSignature)
+	}
+
+	// without a keyring, the content is read unchecked
+	su.Keyring = nil
+	if err := su.fetchInfo(context.Background()); err != nil {
+		t.Errorf("without keyring: %+v", err)
+	}
+}
+
+func TestFetchContextCancel(t *testing.T) {
+	su := &HTTPSelfUpdate{Interval: time.Hour, delay: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := su.FetchContext(ctx); err != context.Canceled {
+		t.Errorf("got %v, awaited %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("cancel took %s", d)
+	}
+}
+
 func testHandler(t *testing.T) http.Handler {
 	const bin = `This is NOT a binary!`
 	sha := sha256.New()
@@ -108,3 +179,106 @@ func testHandler(t *testing.T) http.Handler {
 		}
 	})
 }
+
+func TestBelowMinimum(t *testing.T) {
+	sha := func(s string) []byte { return GetSha(strings.NewReader(s)) }
+	info := Info{
+		Sha256:    sha("v4"),
+		History:   [][]byte{sha("v1"), sha("v2"), sha("v3"), sha("v4")},
+		MinSha256: sha("v2"),
+	}
+	for v, await := range map[string]bool{
+		"v1": true, "v2": false, "v3": false, "v4": false, "dev": true,
+	} {
+		if got := info.BelowMinimum(sha(v)); got != await {
+			t.Errorf("%s: got %t, awaited %t", v, got, await)
+		}
+	}
+	info.MinSha256 = nil
+	if info.BelowMinimum(sha("v1")) {
+		t.Error("no minimum: got below")
+	}
+}
+
+func TestRevoked(t *testing.T) {
+	Logf = t.Logf
+	defer withSelf(t, "old")()
+	sha := func(s string) []byte { return GetSha(strings.NewReader(s)) }
+	oldSha, newSha, goodSha := sha("old"), sha("new"), sha("good")
+
+	h := HTTPSelfUpdate{}
+	if err := h.Templates.Init("info.json", "diff/{{.OldSha}}/{{.NewSha}}", "bin/{{.NewSha}}.gz"); err != nil {
+		t.Fatal(err)
+	}
+	bins := make(map[string][]byte)
+	for _, s := range []string{"new", "good"} {
+		path, err := h.pathOf("bin", Info{}, nil, sha(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bins["/"+path] = gzipped(s)
+	}
+	var info Info
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/info.json" {
+			json.NewEncoder(w).Encode(info)
+		} else if b, ok := bins[r.URL.Path]; ok {
+			w.Write(b)
+		} else {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	h.URL = srv.URL
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		Name        string
+		Info        Info
+		Blacklisted []byte
+		Await       string
+		Urgent      bool
+	}{
+		{Name: "running", Info: Info{Sha256: newSha, Revoked: [][]byte{oldSha}}, Await: "new", Urgent: true},
+		{Name: "latest", Info: Info{Sha256: newSha, Revoked: [][]byte{newSha}}},
+		{Name: "latest replaced",
+			Info:  Info{Sha256: newSha, Revoked: [][]byte{newSha}, Replacement: &Info{Sha256: goodSha}},
+			Await: "good"},
+		{Name: "replacement revoked",
+			Info: Info{Sha256: newSha, Revoked: [][]byte{newSha, goodSha}, Replacement: &Info{Sha256: goodSha}}},
+		{Name: "running and replaced",
+			Info:  Info{Sha256: newSha, Revoked: [][]byte{oldSha, newSha}, Replacement: &Info{Sha256: goodSha}},
+			Await: "good", Urgent: true},
+		{Name: "running, latest blacklisted",
+			Info:        Info{Sha256: newSha, Revoked: [][]byte{oldSha}},
+			Blacklisted: newSha},
+		{Name: "replacement blacklisted",
+			Info:        Info{Sha256: newSha, Revoked: [][]byte{oldSha, newSha}, Replacement: &Info{Sha256: goodSha}},
+			Blacklisted: goodSha},
+	} {
+		os.Remove(self + BlacklistSuffix)
+		if tc.Blacklisted != nil {
+			if err := addBlacklist(tc.Blacklisted); err != nil {
+				t.Fatal(err)
+			}
+		}
+		info, h.urgent = tc.Info, false
+		bin, err := h.fetchUpdate(ctx)
+		if err != nil {
+			t.Fatalf("%s: %+v", tc.Name, err)
+		}
+		if string(bin) != tc.Await {
+			t.Errorf("%s: got %q, awaited %q", tc.Name, bin, tc.Await)
+		}
+		if h.urgent != tc.Urgent {
+			t.Errorf("%s: got urgent=%t, awaited %t", tc.Name, h.urgent, tc.Urgent)
+		}
+		check, err := h.CheckForUpdate(ctx)
+		if err != nil {
+			t.Fatalf("%s: %+v", tc.Name, err)
+		}
+		if check.Available != (tc.Await != "") {
+			t.Errorf("%s: got available=%t, awaited %t", tc.Name, check.Available, tc.Await != "")
+		}
+	}
+}
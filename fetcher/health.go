@@ -0,0 +1,222 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/kardianos/osext"
+	"github.com/pkg/errors"
+)
+
+// Suffixes of the files next to the executable, for the health check.
+const (
+	PendingSuffix   = ".pending.json"
+	BlacklistSuffix = ".blacklist.json"
+)
+
+// pendingUpdate is the marker of an update not confirmed healthy yet.
+type pendingUpdate struct {
+	Sha256   []byte    // of the new binary
+	Previous []byte    // sha256 of the previous binary, saved with BackupSuffix
+	Time     time.Time // of handing out the new binary
+}
+
+func selfPath() (string, error) {
+	if self != "" {
+		return self, nil
+	}
+	return osext.Executable()
+}
+
+func readPending(exe string) (*pendingUpdate, error) {
+	b, err := ioutil.ReadFile(exe + PendingSuffix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var p pendingUpdate
+	if err = json.Unmarshal(b, &p); err != nil {
+		return nil, errors.Wrapf(err, "decode %q", exe+PendingSuffix)
+	}
+	return &p, nil
+}
+
+func fileSha(fn string) ([]byte, error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	h := NewSha()
+	if _, err = io.Copy(h, fh); err != nil {
+		return nil, errors.Wrapf(err, "read %q", fn)
+	}
+	return h.Sum(nil), nil
+}
+
+// markPending writes the pending marker of the update to newSha.
+// With backup, it also saves the running binary with BackupSuffix
+// (see saveBackup); without, the caller must do that, as Apply does.
+func markPending(newSha []byte, backup bool) error {
+	prev, err := fileSha(self)
+	if err != nil {
+		return err
+	}
+	if backup {
+		if err = saveBackup(self); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(pendingUpdate{Sha256: newSha, Previous: prev, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(self+PendingSuffix, b, 0644)
+}
+
+// ConfirmHealthy confirms that the running binary works, so it will not be
+// rolled back. The application should call it once it is up.
+func ConfirmHealthy() error {
+	exe, err := selfPath()
+	if err != nil {
+		return err
+	}
+	p, err := readPending(exe)
+	if err != nil || p == nil {
+		return err
+	}
+	cur, err := fileSha(exe)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(cur, p.Sha256) {
+		return nil // not updated yet
+	}
+	logf("update to %s is confirmed healthy", EncodeSha(cur))
+	return os.Remove(exe + PendingSuffix)
+}
+
+// checkHealth checks the pending update: if the running binary is the new one,
+// and it has not been confirmed healthy in HealthTimeout, then blacklists it,
+// and returns the previous binary.
+func (h *HTTPSelfUpdate) checkHealth() ([]byte, error) {
+	p, err := readPending(self)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	expired := time.Since(p.Time) > h.HealthTimeout
+	cur, err := fileSha(self)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(cur, p.Sha256) {
+		if expired { // the update has not been installed
+			os.Remove(self + PendingSuffix)
+		}
+		return nil, nil
+	}
+	if !expired {
+		return nil, nil
+	}
+	logf("update to %s has not been confirmed healthy in %s, rolling back to %s",
+		EncodeSha(p.Sha256), h.HealthTimeout, EncodeSha(p.Previous))
+	if err = addBlacklist(p.Sha256); err != nil {
+		return nil, err
+	}
+	prev, err := ioutil.ReadFile(self + BackupSuffix)
+	if err != nil {
+		return nil, errors.Wrap(err, "read previous binary")
+	}
+	if !verifySha(prev, p.Previous) {
+		return nil, errors.Wrapf(ErrHashMismatch, "previous binary %q", self+BackupSuffix)
+	}
+	if err = os.Remove(self + PendingSuffix); err != nil {
+		return nil, err
+	}
+	return prev, nil
+}
+
+// healthDeadline returns the time till the pending update's health timeout;
+// 0 if there is no pending update.
+func (h *HTTPSelfUpdate) healthDeadline() time.Duration {
+	if h.HealthTimeout <= 0 {
+		return 0
+	}
+	p, err := readPending(self)
+	if err != nil || p == nil {
+		return 0
+	}
+	if d := time.Until(p.Time.Add(h.HealthTimeout)); d > 0 {
+		return d + time.Second
+	}
+	return time.Second
+}
+
+func readBlacklist() ([]string, error) {
+	b, err := ioutil.ReadFile(self + BlacklistSuffix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []string
+	return list, errors.Wrapf(json.Unmarshal(b, &list), "decode %q", self+BlacklistSuffix)
+}
+
+func addBlacklist(sha []byte) error {
+	list, err := readBlacklist()
+	if err != nil {
+		return err
+	}
+	list = append(list, EncodeSha(sha))
+	b, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(self+BlacklistSuffix, b, 0644)
+}
+
+// IsBlacklisted reports whether the binary with the given sha256 has failed
+// the health check, so it must not be installed again.
+func IsBlacklisted(sha []byte) bool {
+	list, err := readBlacklist()
+	if err != nil {
+		logf("read blacklist: %+v", err)
+	}
+	s := EncodeSha(sha)
+	for _, b := range list {
+		if b == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	defer withSelf(t, "old")()
+
+	oldSha, newSha := GetSha(strings.NewReader("old")), GetSha(strings.NewReader("new"))
+	if err := markPending(newSha, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(self, []byte("new"), 0755); err != nil { // installed
+		t.Fatal(err)
+	}
+
+	h := HTTPSelfUpdate{HealthTimeout: time.Hour}
+	if prev, err := h.checkHealth(); err != nil || prev != nil {
+		t.Fatalf("got %q (%v), awaited nothing before the timeout", prev, err)
+	}
+
+	h.HealthTimeout = time.Nanosecond
+	prev, err := h.checkHealth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(prev) != "old" {
+		t.Errorf("got %q, awaited the previous binary", prev)
+	}
+	if !IsBlacklisted(newSha) || IsBlacklisted(oldSha) {
+		t.Error("awaited only the new binary to be blacklisted")
+	}
+	if _, err = os.Stat(self + PendingSuffix); !os.IsNotExist(err) {
+		t.Errorf("pending marker is still there: %v", err)
+	}
+}
+
+func TestConfirmHealthy(t *testing.T) {
+	defer withSelf(t, "old")()
+	err := markPending(GetSha(strings.NewReader("new")), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not installed yet
+	if err = ConfirmHealthy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(self + PendingSuffix); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(self, []byte("new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ConfirmHealthy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(self + PendingSuffix); !os.IsNotExist(err) {
+		t.Errorf("pending marker is still there: %v", err)
+	}
+}
+
+func TestUpdateSelfBackup(t *testing.T) {
+	Logf = t.Logf
+	defer withSelf(t, "old")()
+
+	bin := gzipped("new")
+	infoJSON, err := json.Marshal(Info{Sha256: GetSha(strings.NewReader("new"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/info.json":
+			w.Write(infoJSON)
+		case "/bin.gz":
+			w.Write(bin)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	before, err := os.Stat(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := HTTPSelfUpdate{URL: srv.URL, HealthTimeout: time.Hour}
+	if err = h.Templates.Init("info.json", "diff/{{.OldSha}}", "bin.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := h.UpdateSelf(context.Background()); err != nil || !updated {
+		t.Fatalf("got %t (%+v), awaited the update", updated, err)
+	}
+	// the backup is made by Apply only, not copied for the health check too
+	if after, err := os.Stat(self + BackupSuffix); err != nil {
+		t.Fatal(err)
+	} else if runtime.GOOS != "windows" && !os.SameFile(before, after) {
+		t.Error("the backup is not the previous executable")
+	}
+	p, err := readPending(self)
+	if err != nil || p == nil {
+		t.Fatalf("got %+v (%v), awaited the pending marker", p, err)
+	}
+	if !bytes.Equal(p.Previous, GetSha(strings.NewReader("old"))) {
+		t.Errorf("the previous version is %s, awaited the old", EncodeSha(p.Previous))
+	}
+
+	// without backup, the marker is written, but the running binary is not copied
+	os.Remove(self + BackupSuffix)
+	if err = markPending(GetSha(strings.NewReader("newer")), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(self + BackupSuffix); !os.IsNotExist(err) {
+		t.Errorf("the running binary is copied: %v", err)
+	}
+	if p, err = readPending(self); err != nil || p == nil || !bytes.Equal(p.Previous, GetSha(strings.NewReader("new"))) {
+		t.Errorf("got %+v (%v), awaited the new as the previous version", p, err)
+	}
+}
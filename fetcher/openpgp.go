@@ -23,9 +23,15 @@
 package fetcher
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
 	"strings"
 
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	"github.com/pkg/errors"
 )
 
 // HasKeys iff not nil and has decryption keys.
@@ -44,3 +50,90 @@ func SignerKey(el openpgp.EntityList) *openpgp.Entity {
 	}
 	return nil
 }
+
+// SignedMessageType is the armor type of the signed files (info, chunk index).
+const SignedMessageType = "PGP MESSAGE"
+
+// ErrBadSignature is returned when the signature does not match.
+var ErrBadSignature = errors.New("bad signature")
+
+// IsSignedMessage reports whether b is an armored OpenPGP message, as the signed
+// files are published, and not a plain one (with a detached signature).
+func IsSignedMessage(b []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN "+SignedMessageType+"-----"))
+}
+
+// WriteSigned writes b to w as an armored message signed by the signer key of keyring,
+// so the content and its signature are published in one file.
+func WriteSigned(w io.Writer, b []byte, keyring openpgp.EntityList) error {
+	signer := SignerKey(keyring)
+	if signer == nil {
+		return errors.New("no signer key in the keyring")
+	}
+	aw, err := armor.Encode(w, SignedMessageType, nil)
+	if err != nil {
+		return err
+	}
+	sw, err := openpgp.Sign(aw, preferSHA256(signer), nil, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = sw.Write(b); err != nil {
+		return err
+	}
+	if err = sw.Close(); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// ReadSigned returns the content of the signed message b. With keys in keyring,
+// it checks the signature, and returns ErrBadSignature if it does not match.
+func ReadSigned(b []byte, keyring openpgp.KeyRing) ([]byte, error) {
+	block, err := armor.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "decode armor")
+	}
+	if block.Type != SignedMessageType {
+		return nil, errors.Errorf("armor type %q, not %q", block.Type, SignedMessageType)
+	}
+	if keyring == nil {
+		keyring = openpgp.EntityList{}
+	}
+	md, err := openpgp.ReadMessage(block.Body, keyring, KeyPrompt, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "read signed message")
+	}
+	content, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, errors.Wrap(err, "read signed message")
+	}
+	if !HasKeys(keyring) {
+		return content, nil
+	}
+	if !md.IsSigned || md.SignedBy == nil {
+		return nil, errors.Wrap(ErrBadSignature, "not signed by a known key")
+	}
+	if md.SignatureError != nil {
+		return nil, errors.Wrapf(ErrBadSignature, "%v", md.SignatureError)
+	}
+	return content, nil
+}
+
+// preferSHA256 returns a copy of e, which prefers SHA256 for signing, if its
+// self-signatures have no preference (as the keys made by genkeys),
+// as openpgp.Sign would fall back to RIPEMD160.
+func preferSHA256(e *openpgp.Entity) *openpgp.Entity {
+	c := *e
+	c.Identities = make(map[string]*openpgp.Identity, len(e.Identities))
+	for nm, id := range e.Identities {
+		i := *id
+		if i.SelfSignature != nil && len(i.SelfSignature.PreferredHash) == 0 {
+			sig := *i.SelfSignature
+			sig.PreferredHash = []uint8{8} // SHA256, RFC 4880 9.4
+			i.SelfSignature = &sig
+		}
+		c.Identities[nm] = &i
+	}
+	return &c
+}
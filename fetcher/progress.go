@@ -0,0 +1,77 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"io"
+	"time"
+)
+
+// DefaultProgressInterval is the minimal time between two progress reports.
+const DefaultProgressInterval = time.Second
+
+// progressReader reports the bytes read through it, rate-limited.
+type progressReader struct {
+	io.ReadCloser
+	URL         string
+	read, total int64
+	interval    time.Duration
+	last        time.Time
+	done        bool
+	report      func(URL string, read, total int64)
+}
+
+// newProgressReader wraps body to report its progress to OnProgress and Events,
+// if any of them is set.
+func (h *HTTPSelfUpdate) newProgressReader(URL string, body io.ReadCloser, total int64) io.ReadCloser {
+	if h.OnProgress == nil && h.Events == nil {
+		return body
+	}
+	interval := h.ProgressInterval
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+	return &progressReader{
+		ReadCloser: body, URL: URL, total: total, interval: interval,
+		report: func(URL string, read, total int64) {
+			if h.OnProgress != nil {
+				h.OnProgress(URL, read, total)
+			}
+			h.events().DownloadProgress(URL, read, total)
+		},
+	}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	if r.done {
+		return n, err
+	}
+	end := err == io.EOF || r.total > 0 && r.read >= r.total
+	if now := time.Now(); end || now.Sub(r.last) >= r.interval {
+		r.last, r.done = now, end
+		r.report(r.URL, r.read, r.total)
+	}
+	return n, err
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestProgressReader(t *testing.T) {
+	var reports []string
+	h := HTTPSelfUpdate{
+		ProgressInterval: time.Hour,
+		OnProgress: func(URL string, read, total int64) {
+			reports = append(reports, fmt.Sprintf("%s %d/%d", URL, read, total))
+		},
+	}
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	for _, tc := range []struct {
+		Total int64
+		Want  string
+	}{
+		{100, "x 1/100 x 100/100"},
+		{-1, "x 1/-1 x 100/-1"},
+	} {
+		reports = reports[:0]
+		r := h.newProgressReader("x", ioutil.NopCloser(iotest.OneByteReader(bytes.NewReader(data))), tc.Total)
+		if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, data) {
+			t.Fatalf("read %q: %v", b, err)
+		}
+		if got := strings.Join(reports, " "); got != tc.Want {
+			t.Errorf("%d: got %q, awaited %q", tc.Total, got, tc.Want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Window is a maintenance window: the time of day between Start and End
+// (as durations since midnight), on the given Days (every day if empty).
+// If End is before Start, the window spans midnight, and Days are the
+// days it starts on.
+type Window struct {
+	Days       []time.Weekday
+	Start, End time.Duration
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseWindow parses a window such as "Mon-Fri 22:00-04:00", "Sat,Sun 00:00-24:00"
+// or "01:00-05:00" (every day).
+func ParseWindow(s string) (Window, error) {
+	var w Window
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, errors.Errorf("%q: awaited [days] hh:mm-hh:mm", s)
+	}
+	if len(fields) == 2 {
+		for _, part := range strings.Split(fields[0], ",") {
+			from, to := part, part
+			if i := strings.IndexByte(part, '-'); i >= 0 {
+				from, to = part[:i], part[i+1:]
+			}
+			d, ok := weekdays[strings.ToLower(from)]
+			e, ok2 := weekdays[strings.ToLower(to)]
+			if !ok || !ok2 {
+				return w, errors.Errorf("%q: unknown day in %q", s, part)
+			}
+			for {
+				w.Days = append(w.Days, d)
+				if d == e {
+					break
+				}
+				d = (d + 1) % 7
+			}
+		}
+	}
+	times := fields[len(fields)-1]
+	i := strings.IndexByte(times, '-')
+	if i < 0 {
+		return w, errors.Errorf("%q: awaited hh:mm-hh:mm, got %q", s, times)
+	}
+	var err error
+	if w.Start, err = parseTimeOfDay(times[:i]); err != nil {
+		return w, errors.Wrap(err, s)
+	}
+	if w.End, err = parseTimeOfDay(times[i+1:]); err != nil {
+		return w, errors.Wrap(err, s)
+	}
+	if w.Start == w.End || w.Start == 24*time.Hour {
+		return w, errors.Errorf("%q: empty window", s)
+	}
+	return w, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return 0, errors.Errorf("awaited hh:mm, got %q", s)
+	}
+	h, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return 0, errors.Wrap(err, s)
+	}
+	m, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return 0, errors.Wrap(err, s)
+	}
+	d := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute
+	if h < 0 || m < 0 || m > 59 || d > 24*time.Hour {
+		return 0, errors.Errorf("bad time of day %q", s)
+	}
+	return d, nil
+}
+
+// Contains reports whether t is within the window, in t's location.
+func (w Window) Contains(t time.Time) bool {
+	// the wall clock time of the day, as elapsed time is off on DST changes
+	since := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	day := t.Weekday()
+	if w.Start < w.End {
+		return since >= w.Start && since < w.End && w.onDay(day)
+	}
+	// spans midnight
+	if since >= w.Start {
+		return w.onDay(day)
+	}
+	return since < w.End && w.onDay((day+6)%7)
+}
+
+func (w Window) onDay(d time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, x := range w.Days {
+		if x == d {
+			return true
+		}
+	}
+	return false
+}
+
+// InWindow reports whether t is within any of the maintenance windows,
+// or there are no windows.
+func (h *HTTPSelfUpdate) InWindow(t time.Time) bool {
+	if len(h.Windows) == 0 {
+		return true
+	}
+	if h.Location != nil {
+		t = t.In(h.Location)
+	}
+	for _, w := range h.Windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// untilWindow returns the time till the next maintenance window opens
+// (to the minute); 0 if now is within one.
+func (h *HTTPSelfUpdate) untilWindow(now time.Time) time.Duration {
+	t := now
+	for end := now.Add(8 * 24 * time.Hour); t.Before(end); t = t.Truncate(time.Minute).Add(time.Minute) {
+		if h.InWindow(t) {
+			return t.Sub(now)
+		}
+	}
+	return t.Sub(now)
+}
+
+// pendingBinary is a downloaded update, waiting for a maintenance window.
+type pendingBinary struct {
+	Sha256 []byte
+	bin    []byte
+}
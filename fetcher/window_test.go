@@ -0,0 +1,162 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	_ "time/tzdata" // for the DST case
+)
+
+func TestWindow(t *testing.T) {
+	at := func(day, hm string) time.Time {
+		// 2024-01-01 is a Monday
+		t0, err := time.Parse("2006-01-02 15:04", "2024-01-0"+day+" "+hm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return t0
+	}
+	for i, tc := range []struct {
+		Window string
+		In     []time.Time
+		Out    []time.Time
+	}{
+		{"01:00-05:00", []time.Time{at("1", "01:00"), at("7", "04:59")}, []time.Time{at("1", "05:00"), at("3", "00:59")}},
+		{"Mon-Fri 22:00-04:00",
+			[]time.Time{at("1", "22:00"), at("2", "03:00"), at("6", "02:00")},
+			[]time.Time{at("1", "03:00"), at("6", "22:00"), at("3", "12:00")}},
+		{"Sat,Sun 00:00-24:00", []time.Time{at("6", "00:00"), at("7", "23:59")}, []time.Time{at("1", "00:00"), at("5", "23:59")}},
+		{"Fri-Mon 12:00-13:00", []time.Time{at("5", "12:30"), at("1", "12:00")}, []time.Time{at("2", "12:30")}},
+	} {
+		w, err := ParseWindow(tc.Window)
+		if err != nil {
+			t.Fatalf("%d. %q: %v", i, tc.Window, err)
+		}
+		for _, t0 := range tc.In {
+			if !w.Contains(t0) {
+				t.Errorf("%d. %q does not contain %s", i, tc.Window, t0.Format("Mon 15:04"))
+			}
+		}
+		for _, t0 := range tc.Out {
+			if w.Contains(t0) {
+				t.Errorf("%d. %q contains %s", i, tc.Window, t0.Format("Mon 15:04"))
+			}
+		}
+	}
+
+	for _, s := range []string{"", "22:00", "Foo 01:00-02:00", "01:00-01:00", "25:00-26:00", "Mon 01:00-02:00 x"} {
+		if _, err := ParseWindow(s); err == nil {
+			t.Errorf("%q: parsed", s)
+		}
+	}
+
+	// on the day of the DST change, the wall clock is an hour ahead of the elapsed time
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, _ := ParseWindow("22:00-23:00")
+	if t0 := time.Date(2026, 3, 29, 22, 30, 0, 0, berlin); !w.Contains(t0) {
+		t.Errorf("%q does not contain %s", "22:00-23:00", t0)
+	}
+	if t0 := time.Date(2026, 3, 29, 23, 30, 0, 0, berlin); w.Contains(t0) {
+		t.Errorf("%q contains %s", "22:00-23:00", t0)
+	}
+
+	w, _ = ParseWindow("Mon 22:00-23:00")
+	h := HTTPSelfUpdate{Windows: []Window{w}, Location: time.UTC}
+	if d := h.untilWindow(at("1", "21:30")); d != 30*time.Minute {
+		t.Errorf("got %s till the window, awaited 30m", d)
+	}
+	if d := h.untilWindow(at("1", "22:30")); d != 0 {
+		t.Errorf("got %s within the window, awaited 0", d)
+	}
+}
+
+func TestFetchInWindow(t *testing.T) {
+	Logf = t.Logf
+	self = os.Args[0]
+	bin := gzipped("new")
+	infoJSON, err := json.Marshal(Info{Sha256: GetSha(strings.NewReader("new"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var downloaded int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/info.json":
+			w.Write(infoJSON)
+		case "/bin.gz":
+			atomic.AddInt32(&downloaded, 1)
+			w.Write(bin)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// a window which has just closed
+	now := time.Now().UTC()
+	y, m, d := now.Date()
+	since := now.Sub(time.Date(y, m, d, 0, 0, 0, 0, time.UTC)).Truncate(time.Minute)
+	closed := Window{Start: since - 2*time.Hour, End: since - time.Hour}
+	if closed.Start < 0 {
+		closed.Start += 24 * time.Hour
+	}
+	if closed.End < 0 {
+		closed.End += 24 * time.Hour
+	}
+	h := HTTPSelfUpdate{URL: srv.URL, Windows: []Window{closed}, Location: time.UTC}
+	if err := h.Templates.Init("info.json", "diff/{{.OldSha}}", "bin.gz"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	r, err := h.FetchContext(ctx)
+	if err != nil || r != nil {
+		t.Fatalf("got %v (%v) outside the window, awaited nothing", r, err)
+	}
+	if h.pending == nil {
+		t.Fatal("the update has not been downloaded")
+	}
+
+	h.delay = false
+	h.Windows = append(h.Windows, Window{Start: 0, End: 24 * time.Hour})
+	if r, err = h.FetchContext(ctx); err != nil || r == nil {
+		t.Fatalf("got %v (%v) within the window, awaited the update", r, err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "new" {
+		t.Errorf("got %q, awaited %q", b, "new")
+	}
+	if n := atomic.LoadInt32(&downloaded); n != 1 {
+		t.Errorf("downloaded %d times, awaited once", n)
+	}
+}
@@ -0,0 +1,361 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultZsyncBlockSize is the block size of the zsync control files.
+const DefaultZsyncBlockSize = 4 << 10
+
+// zsyncStrongLen is the length of the (truncated) strong checksum of the blocks.
+const zsyncStrongLen = 16
+
+const (
+	// zsyncMergeGap is the largest gap between two missing ranges which is
+	// downloaded, too, to merge them: cheaper than another range.
+	zsyncMergeGap = 64 << 10
+	// zsyncMaxRanges is the maximal number of ranges requested at once.
+	zsyncMaxRanges = 64
+)
+
+// ZsyncControl lists the checksums of the fixed-size blocks of a binary,
+// to be able to find these blocks at any offset in another binary.
+type ZsyncControl struct {
+	Sha256    []byte // of the whole binary
+	Size      int64
+	BlockSize int
+	Weak      []uint32 // rolling checksum of each block
+	Strong    []byte   // truncated sha256 of each block, concatenated
+}
+
+// NewZsyncControl calculates the control for the binary read from r.
+func NewZsyncControl(r io.Reader, blockSize int) (ZsyncControl, error) {
+	if blockSize <= 0 {
+		blockSize = DefaultZsyncBlockSize
+	}
+	ctrl := ZsyncControl{BlockSize: blockSize}
+	all := NewSha()
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			block := buf[:n]
+			all.Write(block)
+			ctrl.Size += int64(n)
+			ctrl.Weak = append(ctrl.Weak, newRollsum(block).Sum())
+			ctrl.Strong = append(ctrl.Strong, strongSum(block)...)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return ctrl, err
+		}
+	}
+	ctrl.Sha256 = all.Sum(nil)
+	return ctrl, nil
+}
+
+func strongSum(b []byte) []byte {
+	h := NewSha()
+	h.Write(b)
+	return h.Sum(nil)[:zsyncStrongLen]
+}
+
+// rollsum is the rsync rolling checksum.
+type rollsum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollsum(b []byte) rollsum {
+	r := rollsum{n: uint32(len(b))}
+	for i, c := range b {
+		r.a += uint32(c)
+		r.b += uint32(len(b)-i) * uint32(c)
+	}
+	return r
+}
+
+// Roll moves the window by one byte: out leaves, in enters.
+func (r *rollsum) Roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r rollsum) Sum() uint32 { return r.a&0xffff | r.b<<16 }
+
+// byteRange is a half-open [start, end) range of the new binary.
+type byteRange struct{ start, end int64 }
+
+// match finds the blocks of the control in old, copies them into the returned
+// new binary, and returns the ranges which are missing.
+func (ctrl ZsyncControl) match(old []byte) ([]byte, []byteRange, error) {
+	bs := ctrl.BlockSize
+	if bs <= 0 || len(ctrl.Strong) != len(ctrl.Weak)*zsyncStrongLen ||
+		int64(len(ctrl.Weak)) != (ctrl.Size+int64(bs)-1)/int64(bs) {
+		return nil, nil, errors.New("bad zsync control")
+	}
+	// the last, partial block is always downloaded
+	full := len(ctrl.Weak)
+	if ctrl.Size%int64(bs) != 0 {
+		full--
+	}
+	blocks := make(map[uint32][]int, full)
+	for i := 0; i < full; i++ {
+		blocks[ctrl.Weak[i]] = append(blocks[ctrl.Weak[i]], i)
+	}
+	found := make([]bool, len(ctrl.Weak))
+	bin := make([]byte, ctrl.Size)
+	var rs rollsum
+	recalc := true
+	for i := 0; i+bs <= len(old); {
+		if recalc {
+			rs, recalc = newRollsum(old[i:i+bs]), false
+		}
+		var matched bool
+		if idxs := blocks[rs.Sum()]; len(idxs) != 0 {
+			strong := strongSum(old[i : i+bs])
+			for _, j := range idxs {
+				if !found[j] && bytes.Equal(strong, ctrl.Strong[j*zsyncStrongLen:(j+1)*zsyncStrongLen]) {
+					copy(bin[j*bs:], old[i:i+bs])
+					found[j], matched = true, true
+				}
+			}
+		}
+		if matched {
+			i, recalc = i+bs, true
+			continue
+		}
+		if i+bs == len(old) {
+			break
+		}
+		rs.Roll(old[i], old[i+bs])
+		i++
+	}
+
+	var missing []byteRange
+	for j, ok := range found {
+		if ok {
+			continue
+		}
+		start, end := int64(j*bs), int64((j+1)*bs)
+		if end > ctrl.Size {
+			end = ctrl.Size
+		}
+		if k := len(missing) - 1; k >= 0 && missing[k].end == start {
+			missing[k].end = end
+		} else {
+			missing = append(missing, byteRange{start: start, end: end})
+		}
+	}
+	return bin, missing, nil
+}
+
+// fetchAndVerifyZsync downloads the signed zsync control of the latest version,
+// finds its blocks in old, and downloads the missing ranges of the raw binary
+// with HTTP Range requests.
+func (h *HTTPSelfUpdate) fetchAndVerifyZsync(ctx context.Context, old io.Reader) ([]byte, error) {
+	if old == nil {
+		return nil, errors.New("empty old")
+	}
+	ctx, cancel := getTimeoutCtx(ctx, h.FetchBinTimeout, DefaultFetchBinTimeout)
+	defer cancel()
+	path, err := h.getPath("zsync", nil, h.Info.Sha256)
+	if err != nil {
+		return nil, err
+	}
+	b, err := h.fetchSigned(ctx, h.URL+"/"+path)
+	if err != nil {
+		return nil, err
+	}
+	var ctrl ZsyncControl
+	if err = json.Unmarshal(b, &ctrl); err != nil {
+		return nil, errors.Wrapf(err, "decode zsync control %q", path)
+	}
+	if !bytes.Equal(ctrl.Sha256, h.Info.Sha256) {
+		return nil, errors.Wrap(ErrHashMismatch, "zsync control")
+	}
+	oldB, err := ioutil.ReadAll(old)
+	if err != nil {
+		return nil, errors.Wrap(err, "read old binary")
+	}
+	bin, missing, err := ctrl.match(oldB)
+	if err != nil {
+		return nil, err
+	}
+	if path, err = h.getPath("raw", nil, h.Info.Sha256); err != nil {
+		return nil, err
+	}
+	missing = mergeRanges(missing, zsyncMergeGap)
+	var downloaded int64
+	for _, rng := range missing {
+		downloaded += rng.end - rng.start
+	}
+	for len(missing) != 0 {
+		n := len(missing)
+		if n > zsyncMaxRanges {
+			n = zsyncMaxRanges
+		}
+		done, err := fetchRanges(ctx, h.URL+"/"+path, missing[:n], bin)
+		if err != nil {
+			return nil, err
+		}
+		if done { // got the whole
+			downloaded = ctrl.Size
+			break
+		}
+		missing = missing[n:]
+	}
+	logf("assembled binary with zsync: reused %d, downloaded %d bytes",
+		ctrl.Size-downloaded, downloaded)
+	return bin, nil
+}
+
+// mergeRanges merges the sorted ranges which are at most gap bytes apart.
+func mergeRanges(rngs []byteRange, gap int64) []byteRange {
+	var merged []byteRange
+	for _, rng := range rngs {
+		if k := len(merged) - 1; k >= 0 && rng.start-merged[k].end <= gap {
+			merged[k].end = rng.end
+			continue
+		}
+		merged = append(merged, rng)
+	}
+	return merged
+}
+
+// fetchRanges reads the given ranges of URL into the same ranges of bin,
+// with one (multi-range) request.
+//
+// If the server does not support ranges, and sends the whole, it is read into bin,
+// and done is true: there's nothing more to fetch.
+func fetchRanges(ctx context.Context, URL string, rngs []byteRange, bin []byte) (done bool, err error) {
+	if strings.HasPrefix(URL, "file://") { // great for testing
+		fh, err := os.Open(URL[7:])
+		if err != nil {
+			return false, err
+		}
+		defer fh.Close()
+		for _, rng := range rngs {
+			if _, err := fh.ReadAt(bin[rng.start:rng.end], rng.start); err != nil {
+				return false, errors.Wrapf(err, "read %q", URL)
+			}
+		}
+		return false, nil
+	}
+	logf("fetch %q in %d ranges", URL, len(rngs))
+	req, err := http.NewRequest("GET", URL, nil)
+	if err != nil {
+		return false, errors.Wrapf(err, "NewRequest(%q)", URL)
+	}
+	req = req.WithContext(ctx)
+	specs := make([]string, len(rngs))
+	for i, rng := range rngs {
+		specs[i] = fmt.Sprintf("%d-%d", rng.start, rng.end-1)
+	}
+	req.Header.Set("Range", "bytes="+strings.Join(specs, ","))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, errors.Wrapf(err, "GET %q", URL)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK: // ranges not supported, this is the whole
+		logf("%q does not support ranges, got the whole", URL)
+		n, err := io.ReadFull(resp.Body, bin)
+		if err != nil {
+			return false, errors.Wrapf(err, "read %q", URL)
+		}
+		if m, _ := io.CopyN(ioutil.Discard, resp.Body, 1); m != 0 {
+			return false, errors.Errorf("%q: got more than %d bytes", URL, n)
+		}
+		return true, nil
+	case http.StatusPartialContent:
+	default:
+		return false, errors.New(fmt.Sprintf("GET ranges failed for %q: %d", URL, resp.StatusCode))
+	}
+
+	var got []byteRange
+	readPart := func(contentRange string, r io.Reader) error {
+		var rng byteRange
+		if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/", &rng.start, &rng.end); err != nil {
+			return errors.Wrapf(err, "parse Content-Range %q", contentRange)
+		}
+		if rng.end++; rng.start < 0 || rng.start >= rng.end || rng.end > int64(len(bin)) {
+			return errors.Errorf("bad Content-Range %q", contentRange)
+		}
+		if _, err := io.ReadFull(r, bin[rng.start:rng.end]); err != nil {
+			return errors.Wrapf(err, "read range of %q", URL)
+		}
+		got = append(got, rng)
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		// the server merged the ranges into one
+		err = readPart(resp.Header.Get("Content-Range"), resp.Body)
+	} else {
+		mr := multipart.NewReader(resp.Body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return false, errors.Wrapf(err, "read parts of %q", URL)
+			}
+			if err = readPart(part.Header.Get("Content-Range"), part); err != nil {
+				return false, err
+			}
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	// check that all the requested ranges have arrived
+	for _, rng := range rngs {
+		var ok bool
+		for _, g := range got {
+			if ok = g.start <= rng.start && rng.end <= g.end; ok {
+				break
+			}
+		}
+		if !ok {
+			return false, errors.Errorf("%q: range [%d-%d) is missing from the response", URL, rng.start, rng.end)
+		}
+	}
+	return false, nil
+}
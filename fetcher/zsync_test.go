@@ -0,0 +1,183 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestZsync(t *testing.T) {
+	Logf = t.Logf
+	rnd := rand.New(rand.NewSource(3))
+	old := make([]byte, 1<<20+123)
+	rnd.Read(old)
+	cur := append(append(append([]byte{}, old[:300000]...), "inserted"...), old[300000:]...)
+	copy(cur[700000:], "overwritten")
+
+	ctrl, err := NewZsyncControl(bytes.NewReader(cur), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrlJSON, err := json.Marshal(ctrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var downloaded int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/zsync.json":
+			w.Write(ctrlJSON)
+		case "/raw":
+			lw := &countingWriter{ResponseWriter: w}
+			http.ServeContent(lw, r, "raw", time.Time{}, bytes.NewReader(cur))
+			atomic.AddInt64(&downloaded, lw.n)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	h := HTTPSelfUpdate{URL: srv.URL}
+	if err := h.Templates.Init("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Templates.InitZsync("raw", "zsync.json"); err != nil {
+		t.Fatal(err)
+	}
+	h.Info.Sha256, h.Info.Zsync = ctrl.Sha256, true
+	got, err := h.fetchAndVerifyZsync(context.Background(), bytes.NewReader(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, cur) {
+		t.Fatal("assembled binary mismatch")
+	}
+	if n := atomic.LoadInt64(&downloaded); n == 0 || n > 4*DefaultZsyncBlockSize {
+		t.Errorf("downloaded %d bytes of %d", n, len(cur))
+	}
+}
+
+func TestZsyncScattered(t *testing.T) {
+	Logf = t.Logf
+	rnd := rand.New(rand.NewSource(4))
+	old := make([]byte, 8<<20)
+	rnd.Read(old)
+	cur := append([]byte{}, old...)
+	const changes, spacing = 100, 80 << 10
+	for i := 0; i < changes; i++ {
+		cur[i*spacing+rnd.Intn(1000)]++
+	}
+
+	ctrl, err := NewZsyncControl(bytes.NewReader(cur), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrlJSON, err := json.Marshal(ctrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests, downloaded int64
+	var noRange bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/zsync.json":
+			w.Write(ctrlJSON)
+		case "/raw":
+			atomic.AddInt64(&requests, 1)
+			lw := &countingWriter{ResponseWriter: w}
+			if noRange {
+				lw.Write(cur)
+			} else {
+				http.ServeContent(lw, r, "raw", time.Time{}, bytes.NewReader(cur))
+			}
+			atomic.AddInt64(&downloaded, lw.n)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	h := HTTPSelfUpdate{URL: srv.URL}
+	if err := h.Templates.Init("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Templates.InitZsync("raw", "zsync.json"); err != nil {
+		t.Fatal(err)
+	}
+	h.Info.Sha256, h.Info.Zsync = ctrl.Sha256, true
+	got, err := h.fetchAndVerifyZsync(context.Background(), bytes.NewReader(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, cur) {
+		t.Fatal("assembled binary mismatch")
+	}
+	if n := atomic.LoadInt64(&requests); n != (changes+zsyncMaxRanges-1)/zsyncMaxRanges {
+		t.Errorf("sent %d requests for %d changes", n, changes)
+	}
+	if n := atomic.LoadInt64(&downloaded); n > 2*changes*DefaultZsyncBlockSize+changes*200 {
+		t.Errorf("downloaded %d bytes of %d", n, len(cur))
+	}
+
+	// a server ignoring Range sends the whole at the first request
+	noRange, requests, downloaded = true, 0, 0
+	if got, err = h.fetchAndVerifyZsync(context.Background(), bytes.NewReader(old)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, cur) {
+		t.Fatal("assembled binary mismatch without Range support")
+	}
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Errorf("sent %d requests to a server without Range support", n)
+	}
+	if n := atomic.LoadInt64(&downloaded); n != int64(len(cur)) {
+		t.Errorf("downloaded %d bytes of %d without Range support", n, len(cur))
+	}
+}
+
+func TestMergeRanges(t *testing.T) {
+	got := mergeRanges([]byteRange{{0, 10}, {15, 20}, {100, 110}, {111, 120}}, 5)
+	await := []byteRange{{0, 20}, {100, 120}}
+	if len(got) != len(await) || got[0] != await[0] || got[1] != await[1] {
+		t.Errorf("got %v, awaited %v", got, await)
+	}
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -24,7 +24,7 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
+	"debug/buildinfo"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -43,7 +43,6 @@ import (
 	"golang.org/x/crypto/openpgp/packet"
 	_ "golang.org/x/crypto/ripemd160"
 
-	"github.com/kr/binarydist"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/tgulacsi/overseer-bindiff/fetcher"
@@ -69,57 +68,107 @@ func main() {
 		Use: "main",
 	}
 
-	var infoPath, diffPath, binPath, keyringPath string
+	var infoPath, diffPath, binPath, indexPath, chunkPath, rawPath, zsyncPath, keyringPath string
+	var reportPath string
+	var force bool
+	var opts genOptions
 	cmdGenerate := &cobra.Command{
 		Use: "generate",
-		Run: func(_ *cobra.Command, args []string) {
-			appPath, err := getAppPath(args[0])
+		Run: func(cmd *cobra.Command, args []string) {
+			F := cmd.Flags()
+			platGiven := F.Changed("os") || F.Changed("arch") ||
+				os.Getenv("GOOS") != "" || os.Getenv("GOARCH") != ""
+			targets, err := findTargets(args[0], fetcher.Platform{GOOS: goos, GOARCH: goarch}, platGiven)
 			if err != nil {
 				log.Fatal(err)
 			}
-
-			var keyring openpgp.EntityList
-			if keyringPath != "" {
-				fh, err := os.Open(keyringPath)
-				if err != nil {
-					log.Fatal(err)
-				}
-				keyring, err = openpgp.ReadArmoredKeyRing(fh)
-				fh.Close()
-				if err != nil {
+			for i := range targets {
+				if err := checkPlatform(&targets[i], force); err != nil {
 					log.Fatal(err)
 				}
 			}
+
+			keyring, err := readKeyringFile(keyringPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if opts.Zsync && keyring != nil {
+				log.Fatal("--zsync publishes the raw binary, so it cannot be used with encryption (--keyring).")
+			}
 			var tpl fetcher.Templates
 			if err := tpl.Init(infoPath, diffPath, binPath); err != nil {
 				log.Fatal(err)
 			}
-			os.MkdirAll(genDir, 0755)
-
-			src, err := os.Open(appPath)
-			if err != nil {
-				log.Fatal(errors.Wrapf(err, "open %q", appPath))
+			if err := tpl.InitChunks(indexPath, chunkPath); err != nil {
+				log.Fatal(err)
 			}
-			err = createUpdate(genDir, tpl, src,
-				fetcher.Platform{GOOS: goos, GOARCH: goarch},
-				keyring,
-			)
-			src.Close()
-			if err != nil {
+			if err := tpl.InitZsync(rawPath, zsyncPath); err != nil {
 				log.Fatal(err)
 			}
-			return
+			if !opts.DryRun {
+				os.MkdirAll(genDir, 0755)
+			}
+
+			results := make([]genResult, 0, len(targets))
+			var failed int
+			for _, t := range targets {
+				res := genResult{Path: t.Path, Platform: t.Platform}
+				src, err := os.Open(t.Path)
+				if err != nil {
+					res.Err = errors.Wrapf(err, "open %q", t.Path)
+				} else {
+					res.updateReport, res.Err = createUpdate(genDir, tpl, src, t.Platform, keyring, opts)
+					src.Close()
+				}
+				if res.Err != nil {
+					log.Printf("%s_%s: %+v", t.GOOS, t.GOARCH, res.Err)
+					failed++
+				}
+				results = append(results, res)
+			}
+			summary := os.Stdout
+			if reportPath == "-" {
+				summary = os.Stderr
+			}
+			printSummary(summary, results)
+			if reportPath != "" {
+				if err := writeReport(reportPath, results); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if failed != 0 {
+				log.Fatalf("%d of %d updates failed.", failed, len(results))
+			}
 		},
 	}
 	F := cmdGenerate.Flags()
 	F.StringVar(&goos, "os", goos,
-		"Target OS. Defaults to running os or the environment variable GOOS.")
+		"Target OS. Defaults to the binary's, the environment variable GOOS, or the running os.")
 	F.StringVar(&goarch, "arch", goarch,
-		"Target ARCH. Defaults to running arch or the environment variable GOARCH.")
+		"Target ARCH. Defaults to the binary's, the environment variable GOARCH, or the running arch.")
+	F.StringVar(&opts.DiffFormat, "diff-format", fetcher.DiffBsdiff,
+		"diff format, one of "+strings.Join(fetcher.DiffFormats(), ", "))
+	F.StringVar(&opts.Compression, "compression", fetcher.CompressGzip,
+		"compression of the full binary, one of "+strings.Join(fetcher.Compressions, ", "))
+	F.StringVar(&opts.DiffCompression, "diff-compression", fetcher.CompressNone,
+		"compression of the diffs, one of "+strings.Join(fetcher.Compressions, ", ")+
+			", or auto for the smallest (needs up-to-date fetchers)")
+	F.BoolVar(&opts.Clean, "clean", false, "remove the stale diffs generated before, if unmodified")
+	F.StringVar(&reportPath, "report", "", "write a JSON report of the generated files to this file (- for stdout)")
+	F.BoolVar(&opts.Critical, "critical", false, "critical update, to be installed as soon as possible")
+	F.StringVar(&opts.Min, "min", "", "sha256 or binary of the minimum supported release")
+	F.BoolVar(&opts.DryRun, "dry-run", false, "show what would be published, without writing into the output directory")
+	F.BoolVar(&force, "force", false, "publish even if the binary's headers disagree with the target platform")
 	F.StringVar(&infoPath, "info", fetcher.DefaultInfoPath, "info path template")
 	F.StringVar(&diffPath, "diff", fetcher.DefaultDiffPath, "diff path template")
 	F.StringVar(&binPath, "bin", fetcher.DefaultBinPath, "binary path template")
+	F.StringVar(&indexPath, "index", fetcher.DefaultIndexPath, "chunk index path template")
+	F.StringVar(&chunkPath, "chunk", fetcher.DefaultChunkPath, "chunk path template")
+	F.StringVar(&rawPath, "raw", fetcher.DefaultRawPath, "uncompressed binary path template, for zsync")
+	F.StringVar(&zsyncPath, "zsync-control", fetcher.DefaultZsyncPath, "zsync control path template")
 	F.StringVar(&keyringPath, "keyring", "", "gpg keyring to use")
+	F.BoolVar(&opts.Chunks, "chunks", false, "publish content-defined chunks, for large binaries")
+	F.BoolVar(&opts.Zsync, "zsync", false, "publish the raw binary and its block checksums, for diffing on the client")
 	cmdMain.AddCommand(cmdGenerate)
 
 	{
@@ -240,12 +289,41 @@ var keyring = readKeyring(strings.NewReader(
 	cmdPrintKeys.Flags().BoolVar(&goOut, "go-out", false, "go output, not just the armored keyring")
 	cmdMain.AddCommand(cmdPrintKeys)
 
+	cmdMain.AddCommand(verifyCommand())
+	cmdMain.AddCommand(serveCommand())
+	cmdMain.AddCommand(revokeCommand())
+
 	if _, _, err := cmdMain.Find(os.Args[1:]); err != nil {
 		os.Args = append(append(make([]string, 0, len(os.Args)+1), os.Args[0], "generate"), os.Args[1:]...)
 	}
 	cmdMain.Execute()
 }
 
+// readKeyringFile reads all the armored keys from the file.
+// Returns nil for an empty path.
+func readKeyringFile(path string) (openpgp.EntityList, error) {
+	if path == "" {
+		return nil, nil
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	var keyring openpgp.EntityList
+	for {
+		el, err := openpgp.ReadArmoredKeyRing(fh)
+		if err != nil {
+			if len(keyring) == 0 {
+				return nil, errors.Wrapf(err, "read keyring %q", path)
+			}
+			break
+		}
+		keyring = append(keyring, el...)
+	}
+	return keyring, nil
+}
+
 func genAndSer(w io.Writer, nce, defName, defComment, defEmail string, confs ...PackConf) error {
 	name, comment, email := splitNCE(nce, defName, defComment, defEmail)
 	conf := &packet.Config{RSABits: DefaultRSABits}
@@ -329,14 +407,117 @@ func splitNCE(nce, defName, defComment, defEmail string) (name, comment, email s
 	return name, comment, email
 }
 
-func createUpdate(genDir string, tpl fetcher.Templates, src io.ReadSeeker, plat fetcher.Platform, keyring openpgp.EntityList) error {
+// genOptions are the options of createUpdate.
+type genOptions struct {
+	// Clean removes the stale diffs created by generate before.
+	Clean bool
+	// DiffFormat is the name of the fetcher.DiffFormat to use.
+	DiffFormat string
+	// Compression is the compression of the full binary.
+	Compression string
+	// DiffCompression is the compression of the diffs, CompressNone if empty,
+	// as the older fetchers cannot decompress them; "auto" tries all,
+	// and chooses the smallest.
+	DiffCompression string
+	// Chunks publishes the content-defined chunks of the binary, and their index.
+	Chunks bool
+	// Zsync publishes the uncompressed binary and its block checksums.
+	Zsync bool
+	// DryRun does everything, but does not write into the output directory.
+	DryRun bool
+	// Critical marks the release as a critical update.
+	Critical bool
+	// Min is the sha256 or the binary of the minimum supported release;
+	// empty keeps the previous one.
+	Min string
+}
+
+// genResult is the outcome of generating the update for one binary.
+type genResult struct {
+	fetcher.Platform
+	Path string
+	updateReport
+	Err   error  `json:"-"`
+	Error string `json:",omitempty"`
+}
+
+// updateReport is the report of createUpdate.
+type updateReport struct {
+	NewSha  string
+	Size    int64        // of the binary
+	Seconds float64      // elapsed
+	Files   []reportFile `json:",omitempty"` // the written files
+	Diffs   []reportDiff `json:",omitempty"`
+}
+
+type reportFile struct {
+	Path string // relative to the output directory
+	Kind string
+	Size int64
+}
+
+type reportDiff struct {
+	OldSha, Path string
+	Status       string // written, skipped (up to date) or failed
+	Compression  string `json:",omitempty"`
+	RawSize      int64  `json:",omitempty"` // before compression
+	Size         int64  `json:",omitempty"`
+	Seconds      float64
+	Error        string `json:",omitempty"`
+}
+
+// writeReport writes the results as JSON to fn, or to stdout if fn is "-".
+func writeReport(fn string, results []genResult) error {
+	for i, res := range results {
+		if res.Err != nil {
+			results[i].Error = res.Err.Error()
+		}
+	}
+	b, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if fn == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return errors.Wrapf(ioutil.WriteFile(fn, b, 0644), "write report %q", fn)
+}
+
+func printSummary(w io.Writer, results []genResult) {
+	for _, res := range results {
+		status := "OK"
+		if res.Err != nil {
+			status = "FAILED: " + res.Err.Error()
+		}
+		fmt.Fprintf(w, "%s_%s\t%s\t%s\t%s\n", res.GOOS, res.GOARCH, res.NewSha, res.Path, status)
+	}
+}
+
+// srcName returns the file name of src, if it has one.
+func srcName(src io.Reader) string {
+	if f, ok := src.(interface {
+		Name() string
+	}); ok {
+		return f.Name()
+	}
+	return fmt.Sprintf("%T", src)
+}
+
+// createUpdate generates the update files for the binary read from src,
+// and returns the report of it, with the encoded sha256 of the binary.
+func createUpdate(genDir string, tpl fetcher.Templates, src io.ReadSeeker, plat fetcher.Platform, keyring openpgp.EntityList, opts genOptions) (rep updateReport, err error) {
+	start := time.Now()
+	defer func() { rep.Seconds = time.Since(start).Seconds() }()
+
 	// generate the sha256 of the binary
 	h := fetcher.NewSha()
-	if _, err := io.Copy(h, src); err != nil {
-		return errors.Wrapf(err, "hash %q", src)
+	if rep.Size, err = io.Copy(h, src); err != nil {
+		return rep, errors.Wrapf(err, "hash %q", src)
 	}
 	if _, err := src.Seek(0, 0); err != nil {
-		return errors.Wrapf(err, "seek back to the beginning of %q", src)
+		return rep, errors.Wrapf(err, "seek back to the beginning of %q", src)
 	}
 	var mtime time.Time
 	if str, ok := src.(interface {
@@ -347,16 +528,71 @@ func createUpdate(genDir string, tpl fetcher.Templates, src io.ReadSeeker, plat
 		}
 	}
 	newSha := h.Sum(nil)
+	rep.NewSha = fetcher.EncodeSha(newSha)
+	var build *fetcher.BuildInfo
+	if ra, ok := src.(io.ReaderAt); ok {
+		if bi, err := buildinfo.Read(ra); err != nil {
+			log.Printf("No Go build info in %q: %v", srcName(src), err)
+		} else {
+			build = fetcher.NewBuildInfo(bi)
+			log.Printf("Build info: %s", build)
+		}
+	}
+	if opts.Compression == "" {
+		opts.Compression = fetcher.CompressGzip
+	}
 	info := fetcher.URLInfo{
 		Platform:    plat,
 		NewSha:      fetcher.EncodeSha(newSha),
+		Compression: opts.Compression,
 		IsEncrypted: keyring != nil,
 	}
+	infoPath, err := tpl.Execute(tpl.Info, info)
+	if err != nil {
+		return rep, errors.Wrapf(err, "execute info template")
+	}
+	// the revoked releases are kept
+	prevInfo, err := readInfoFile(filepath.Join(genDir, infoPath))
+	if err != nil {
+		return rep, err
+	}
+	if prevInfo.IsRevoked(newSha) {
+		return rep, errors.Errorf("%s is revoked, see revoke --undo", info.NewSha)
+	}
+	minSha := prevInfo.MinSha256
+	if opts.Min != "" {
+		if minSha, err = releaseSha(opts.Min); err != nil {
+			return rep, err
+		}
+	}
+
+	manifest, err := readManifest(genDir)
+	if err != nil {
+		return rep, err
+	}
+	newPub := newPublisher
+	if opts.DryRun {
+		newPub = newDryRunPublisher
+	}
+	pub, err := newPub(genDir)
+	if err != nil {
+		return rep, err
+	}
+	defer pub.Abort()
+	record := func(rel string, f genFile) error {
+		f.Platform, f.NewSha = plat, info.NewSha
+		if err := manifest.add(rel, pub.Staged(rel), f); err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		rep.Files = append(rep.Files, reportFile{Path: rel, Kind: f.Kind, Size: manifest.Files[rel].Size})
+		return nil
+	}
 
-	// gzip the binary to its destination
+	// compress the binary to its destination
 	binPath, err := tpl.Execute(tpl.Bin, info)
 	if err != nil {
-		return errors.Wrapf(err, "execute bin template")
+		return rep, errors.Wrapf(err, "execute bin template")
 	}
 	binPathNE := binPath
 	if info.IsEncrypted {
@@ -365,81 +601,143 @@ func createUpdate(genDir string, tpl fetcher.Templates, src io.ReadSeeker, plat
 		binPathNE, _ = tpl.Execute(tpl.Bin, infoNE)
 	}
 
-	binPath = filepath.Join(genDir, binPath)
-	log.Printf("Writing binary to %q.", binPath)
-	os.MkdirAll(filepath.Dir(binPath), 0755)
-	fh, err := os.Create(binPath)
+	log.Printf("Writing binary to %q.", pub.Path(binPath))
+	fh, err := pub.Create(binPath)
 	if err != nil {
-		return errors.Wrapf(err, "create %q", binPath)
+		return rep, err
 	}
 	defer fh.Close()
 	wc := io.WriteCloser(fh)
 	if keyring != nil {
 		if wc, err = encrypt(fh, binPathNE, mtime, keyring); err != nil {
-			return errors.Wrap(err, "Encrypt")
+			return rep, errors.Wrap(err, "Encrypt")
 		}
 	}
-	w := gzip.NewWriter(wc)
+	w, err := fetcher.NewCompressor(opts.Compression, wc)
+	if err != nil {
+		return rep, err
+	}
 	if _, err := io.Copy(w, src); err != nil {
-		return errors.Wrapf(err, "gzip %q into %q", src, fh.Name())
+		return rep, errors.Wrapf(err, "%s %q into %q", opts.Compression, src, fh.Name())
 	}
 	if err := w.Close(); err != nil {
-		return errors.Wrapf(err, "flush gzip into %q", fh.Name())
+		return rep, errors.Wrapf(err, "flush %s into %q", opts.Compression, fh.Name())
 	}
 	if keyring != nil {
 		if err := wc.Close(); err != nil {
-			return err
+			return rep, err
 		}
 	}
 	if err := fh.Close(); err != nil {
-		return errors.Wrapf(err, "close %q", fh.Name())
+		return rep, errors.Wrapf(err, "close %q", fh.Name())
+	}
+	if err := record(binPath, genFile{Kind: kindBin, Compression: opts.Compression}); err != nil {
+		return rep, err
 	}
 
-	// write info.json
-	infoPath, err := tpl.Execute(tpl.Info, info)
+	info.OldSha = oldShaPlaceholder
+	diffPath, err := tpl.Execute(tpl.Diff, info)
 	if err != nil {
-		return errors.Wrapf(err, "execute info template")
+		return rep, errors.Wrapf(err, "execute diff template")
 	}
-	infoPath = filepath.Join(genDir, infoPath)
-	log.Printf("Writing info to %q.", infoPath)
-	os.MkdirAll(filepath.Dir(infoPath), 0755)
-	fh, err = os.Create(infoPath)
-	if err != nil {
-		return errors.Wrapf(err, "create %q", infoPath)
+	info.OldSha = ""
+	if opts.DiffFormat == "" {
+		opts.DiffFormat = fetcher.DiffBsdiff
 	}
-	var buf bytes.Buffer
-	err = json.NewEncoder(io.MultiWriter(fh, &buf)).
-		Encode(fetcher.Info{Sha256: newSha})
-	if closeErr := fh.Close(); closeErr != nil && err == nil {
-		err = errors.Wrapf(err, "close info %q", fh.Name())
+	format, err := fetcher.GetDiffFormat(opts.DiffFormat)
+	if err != nil {
+		return rep, err
+	}
+	diffCompressions := []string{fetcher.CompressNone}
+	switch opts.DiffCompression {
+	case "auto":
+		diffCompressions = fetcher.Compressions
+	case "", fetcher.CompressNone:
+		if opts.DiffFormat == fetcher.DiffZstd {
+			// a plain zstd diff would be mistaken for a compressed one
+			log.Printf("The %s diffs are compressed, as they cannot be published plain.", opts.DiffFormat)
+			diffCompressions = fetcher.Compressions
+		}
+	default:
+		diffCompressions = []string{opts.DiffCompression}
 	}
+	diffs, err := generateDiffs(pub, manifest, diffPath, binPath, keyring, opts.DiffFormat, format, diffCompressions)
 	if err != nil {
-		return errors.Wrapf(err, "encode %v into %q", newSha, fh.Name())
+		return rep, err
+	}
+	for _, diff := range diffs {
+		rd := reportDiff{
+			OldSha: diff.OldSha, Path: filepath.ToSlash(diff.Path), Status: diff.Status,
+			Compression: diff.Compression, RawSize: diff.RawSize, Size: diff.Size, Seconds: diff.Seconds,
+		}
+		if diff.Err != nil {
+			rd.Error = diff.Err.Error()
+		}
+		rep.Diffs = append(rep.Diffs, rd)
+		if diff.Status != diffWritten {
+			continue
+		}
+		if err := record(diff.Path, genFile{
+			Kind: kindDiff, OldSha: diff.OldSha, Format: opts.DiffFormat, Compression: diff.Compression,
+		}); err != nil {
+			return rep, err
+		}
 	}
 
-	if keyring != nil {
-		fh, err := os.Create(fh.Name() + ".asc")
-		if err != nil {
-			return err
+	if opts.Chunks {
+		if _, err := src.Seek(0, 0); err != nil {
+			return rep, errors.Wrapf(err, "seek back to the beginning of %q", srcName(src))
 		}
-		log.Printf("Signing %q", buf.String())
-		err = openpgp.ArmoredDetachSign(fh,
-			fetcher.SignerKey(keyring),
-			bytes.NewReader(buf.Bytes()), nil)
-		if closeErr := fh.Close(); closeErr != nil && err == nil {
-			err = closeErr
+		if err := writeChunks(pub, tpl, info, src, newSha, keyring, record); err != nil {
+			return rep, err
 		}
-		if err != nil {
-			return err
+	}
+	if opts.Zsync {
+		if keyring != nil {
+			return rep, errors.New("zsync cannot be used with encryption")
+		}
+		if _, err := src.Seek(0, 0); err != nil {
+			return rep, errors.Wrapf(err, "seek back to the beginning of %q", srcName(src))
+		}
+		if err := writeZsync(pub, tpl, info, src, record); err != nil {
+			return rep, err
 		}
 	}
 
-	info.OldSha = oldShaPlaceholder
-	diffPath, err := tpl.Execute(tpl.Diff, info)
-	if err != nil {
-		return errors.Wrapf(err, "execute diff template")
+	// write info.json, and its signature
+	var buf bytes.Buffer
+	if err = json.NewEncoder(&buf).Encode(fetcher.Info{
+		Sha256: newSha, Build: build, DiffFormat: opts.DiffFormat, Chunked: opts.Chunks,
+		Zsync: opts.Zsync, Compression: opts.Compression,
+		BinSize: manifest.Files[filepath.ToSlash(binPath)].Size,
+		Revoked: prevInfo.Revoked, Critical: opts.Critical,
+		History: appendHistory(prevInfo.History, newSha), MinSha256: minSha,
+	}); err != nil {
+		return rep, errors.Wrapf(err, "encode %v", newSha)
+	}
+	log.Printf("Writing info %q to %q.", buf.String(), pub.Path(infoPath))
+	if err = writeSigned(pub, infoPath, buf.Bytes(), keyring); err != nil {
+		return rep, err
 	}
-	return generateDiffs(filepath.Join(genDir, diffPath), binPath, keyring)
+	if err := record(infoPath, genFile{Kind: kindInfo}); err != nil {
+		return rep, err
+	}
+
+	// the manifest is published with the files, so it records all the live ones
+	if err := manifest.stage(pub); err != nil {
+		return rep, err
+	}
+	if err := pub.Commit(); err != nil {
+		return rep, err
+	}
+	if !opts.Clean {
+		return rep, nil
+	}
+	manifest.clean(genDir, plat, info.NewSha, opts.DryRun)
+	if opts.DryRun {
+		return rep, nil
+	}
+	return rep, manifest.save(genDir)
 }
 
 func encrypt(w io.Writer, fn string, mtime time.Time, keyring openpgp.EntityList) (io.WriteCloser, error) {
@@ -453,38 +751,51 @@ func encrypt(w io.Writer, fn string, mtime time.Time, keyring openpgp.EntityList
 
 const oldShaPlaceholder = "{{OLDSHA}}"
 
+// diffFile is a diff written by generateDiffs.
+type diffFile struct {
+	Path   string // relative to the output directory
+	OldSha string
+	// Compression is the outer compression of the diff.
+	Compression string
+	// Status is one of diffWritten, diffSkipped (up to date) or diffFailed.
+	Status string
+	// RawSize and Size are the sizes of the diff before and after compression.
+	RawSize, Size int64
+	Seconds       float64 // spent calculating the diff
+	Err           error
+}
+
+const (
+	diffWritten = "written"
+	diffSkipped = "skipped"
+	diffFailed  = "failed"
+)
+
 // generateDiffs calculates and writes the differences between the current
-// binary and the old binaries, into diffPath.
+// binary and the old binaries, into diffPath, staged in pub.
 //
-// binPath must be the current binary's filename (with full path),
+// binPath must be the current binary's path, relative to the output directory,
 // and the old binaries are searched in that directory;
 //
-// diffPath should be the full path for the difference between the current
+// diffPath should be the relative path for the difference between the current
 // binary and the binary named as oldShaPlaceholder.
-func generateDiffs(diffPath, binPath string, keyring openpgp.KeyRing) error {
+//
+// The diffs are calculated with format, named formatName.
+// Diffs already in place, as recorded in the manifest, are not recalculated.
+//
+// Returns the written diffs.
+func generateDiffs(pub *publisher, manifest *genManifest, diffPath, binPath string, keyring openpgp.EntityList, formatName string, format fetcher.DiffFormat, compressions []string) ([]diffFile, error) {
 	hasKeyring := fetcher.HasKeys(keyring)
-	binDir, currentName := filepath.Split(binPath)
+	binDir, currentName := filepath.Split(pub.Path(binPath))
 	files, err := ioutil.ReadDir(binDir)
-	if err != nil {
-		return errors.Wrapf(err, "read %q", binDir)
-	}
-	getSha := func(fn string) string {
-		fn = filepath.Base(fn)
-		if hasKeyring {
-			fn = strings.TrimSuffix(fn, ".gpg")
-		}
-		if ext := filepath.Ext(fn); ext != "" {
-			return fn[:len(fn)-len(ext)]
-		}
-		return fn
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "read %q", binDir)
 	}
+	curPath := pub.Staged(binPath)
 
-	currentRaw, err := os.Open(binPath)
-	if err != nil {
-		return errors.Wrapf(err, "open %q", binPath)
-	}
-	defer currentRaw.Close()
+	newSha := shaFromBinName(currentName, hasKeyring)
 
+	var diffs []diffFile
 	for _, file := range files {
 		if file.IsDir() {
 			continue
@@ -492,44 +803,145 @@ func generateDiffs(diffPath, binPath string, keyring openpgp.KeyRing) error {
 		if file.Name() == currentName {
 			continue
 		}
-		oldSha := getSha(file.Name())
+		oldSha := shaFromBinName(file.Name(), hasKeyring)
+		if oldSha == newSha { // the same binary, compressed differently
+			continue
+		}
 
 		fn := filepath.Join(binDir, file.Name())
-		log.Printf("Calculating diff between %q and %q.", fn, binPath)
 		diffName := strings.Replace(diffPath, oldShaPlaceholder, oldSha, -1)
+		if manifest.has(pub.dir, diffName, oldSha, newSha, formatName) {
+			log.Printf("Diff %q is up to date.", pub.Path(diffName))
+			diffs = append(diffs, diffFile{Path: diffName, OldSha: oldSha, Status: diffSkipped})
+			continue
+		}
+		log.Printf("Calculating diff between %q and %q.", fn, curPath)
+		start := time.Now()
 
 		old, err := openBin(fn, keyring)
 		if err != nil {
 			log.Println(err)
+			diffs = append(diffs, diffFile{Path: diffName, OldSha: oldSha, Status: diffFailed, Err: err})
 			continue
 		}
-		cur, err := openBin(binPath, keyring)
+		cur, err := openBin(curPath, keyring)
 		if err != nil {
-			log.Fatal(err)
+			old.Close()
+			return diffs, err
 		}
 
-		emptyDir(filepath.Dir(diffName))
-		os.MkdirAll(filepath.Dir(diffName), 0755)
+		var raw bytes.Buffer
+		err = format.Diff(old, cur, &raw)
+		old.Close()
+		cur.Close()
+		if err != nil {
+			return diffs, errors.Wrapf(err, "calculate binary diff between %q and %q", fn, curPath)
+		}
+		compression, b, err := compressDiff(raw.Bytes(), compressions)
+		if err != nil {
+			return diffs, err
+		}
+		log.Printf("Diff is %d bytes, %d bytes with %s.", raw.Len(), len(b), compression)
 
-		diff, err := os.Create(diffName)
+		diff, err := pub.Create(diffName)
 		if err != nil {
-			old.Close()
-			cur.Close()
-			return errors.Wrapf(err, "create %q", diffName)
+			return diffs, err
+		}
+		w := io.WriteCloser(diff)
+		if hasKeyring {
+			if w, err = encrypt(diff, filepath.Base(diffName), time.Now(), keyring); err != nil {
+				diff.Close()
+				return diffs, err
+			}
+		}
+		_, err = w.Write(b)
+		if hasKeyring && err == nil {
+			err = w.Close()
 		}
-		err = binarydist.Diff(old, cur, diff)
-		old.Close()
-		cur.Close()
 		if err != nil {
-			return errors.Wrapf(err, "calculate binary diffs and write into %q", diff.Name())
+			diff.Close()
+			return diffs, errors.Wrapf(err, "write diff into %q", diff.Name())
 		}
 		if err := diff.Close(); err != nil {
-			return errors.Wrapf(err, "close %q", diff.Name())
+			return diffs, errors.Wrapf(err, "close %q", diff.Name())
 		}
+		diffs = append(diffs, diffFile{
+			Path: diffName, OldSha: oldSha, Compression: compression, Status: diffWritten,
+			RawSize: int64(raw.Len()), Size: int64(len(b)), Seconds: time.Since(start).Seconds(),
+		})
 	}
-	return nil
+	return diffs, nil
+}
+
+// maxHistory is the number of releases kept in the info's History.
+const maxHistory = 100
+
+// appendHistory returns the history with sha as the latest release.
+func appendHistory(history [][]byte, sha []byte) [][]byte {
+	h := make([][]byte, 0, len(history)+1)
+	for _, s := range history {
+		if !bytes.Equal(s, sha) {
+			h = append(h, s)
+		}
+	}
+	h = append(h, sha)
+	if len(h) > maxHistory {
+		h = h[len(h)-maxHistory:]
+	}
+	return h
+}
+
+// compressDiff returns the smallest encoding of the diff with the given
+// compressions, among those the fetcher can detect by their magic bytes.
+func compressDiff(diff []byte, compressions []string) (string, []byte, error) {
+	var bestName string
+	var best []byte
+	for _, name := range compressions {
+		b := diff
+		if name != fetcher.CompressNone {
+			var buf bytes.Buffer
+			w, err := fetcher.NewCompressor(name, &buf)
+			if err != nil {
+				return "", nil, err
+			}
+			if _, err = w.Write(diff); err == nil {
+				err = w.Close()
+			}
+			if err != nil {
+				return "", nil, errors.Wrapf(err, "compress diff with %s", name)
+			}
+			b = buf.Bytes()
+		}
+		if fetcher.SniffCompression(b) != name {
+			// such as an uncompressed zstd diff, which would be mistaken for a compressed one
+			continue
+		}
+		if best == nil || len(b) < len(best) {
+			bestName, best = name, b
+		}
+	}
+	if best == nil {
+		return "", nil, errors.Errorf("none of %q is usable for the diff", compressions)
+	}
+	return bestName, best, nil
+}
+
+// shaFromBinName returns the encoded sha256 from the name of a binary.
+func shaFromBinName(fn string, hasKeyring bool) string {
+	fn = filepath.Base(fn)
+	if hasKeyring {
+		fn = strings.TrimSuffix(fn, ".gpg")
+	}
+	if ext := filepath.Ext(fn); ext != "" {
+		return fn[:len(fn)-len(ext)]
+	}
+	return fn
 }
 
+// openBin opens the (encrypted) compressed binary, and returns its decompressed content.
+//
+// The compression is detected from the content, as the old binaries may be
+// compressed differently than the current one.
 func openBin(fn string, keyring openpgp.KeyRing) (io.ReadCloser, error) {
 	hasKeyring := fetcher.HasKeys(keyring)
 	fh, err := os.Open(fn)
@@ -537,28 +949,23 @@ func openBin(fn string, keyring openpgp.KeyRing) (io.ReadCloser, error) {
 		return nil, errors.Wrapf(err, "open %q", fn)
 	}
 
-	rc := io.ReadCloser(fh)
+	r := io.Reader(fh)
 	if hasKeyring {
-		r, err := decrypt(rc, keyring)
-		if err != nil {
+		if r, err = decrypt(r, keyring); err != nil {
 			fh.Close()
 			return nil, err
 		}
-		return struct {
-			io.Reader
-			io.Closer
-		}{r, fh}, nil
 	}
 
-	gr, err := gzip.NewReader(rc)
+	dr, err := fetcher.NewSniffingDecompressor(r)
 	if err != nil {
 		fh.Close()
-		return nil, errors.Wrapf(err, "gzip decode %q", fn)
+		return nil, errors.Wrapf(err, "decompress %q", fn)
 	}
 	return struct {
 		io.Reader
 		io.Closer
-	}{gr, rc}, nil
+	}{dr, fh}, nil
 }
 
 func decrypt(r io.Reader, keyring openpgp.KeyRing) (io.Reader, error) {
@@ -572,24 +979,9 @@ func decrypt(r io.Reader, keyring openpgp.KeyRing) (io.Reader, error) {
 func printUsage() {
 	fmt.Println(`
 Positional arguments:
-	Single platform: go-selfupdate myapp
-	Cross platform: go-selfupdate /tmp/mybinares/`)
-}
-
-func emptyDir(path string) error {
-	files, err := ioutil.ReadDir(path)
-	if err != nil {
-		return errors.Wrapf(err, "read dir %q", path)
-	}
-	for _, fi := range files {
-		if fi.IsDir() {
-			continue
-		}
-		fn := filepath.Join(path, fi.Name())
-		log.Printf("Deleting %q.", fn)
-		os.Remove(fn)
-	}
-	return nil
+	Single platform: overseer-bindiff generate myapp
+	Cross platform: overseer-bindiff generate /tmp/mybinaries/
+	                overseer-bindiff generate '/tmp/mybinaries/myapp-*'`)
 }
 
 func getAppPath(appPath string) (string, error) {
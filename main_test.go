@@ -0,0 +1,146 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"testing"
+
+	"github.com/tgulacsi/overseer-bindiff/fetcher"
+)
+
+func TestCompressDiff(t *testing.T) {
+	diff := append([]byte("BSDIFF40"), bytes.Repeat([]byte("0123456789"), 1000)...)
+	name, b, err := compressDiff(diff, fetcher.Compressions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name == fetcher.CompressNone || len(b) >= len(diff) {
+		t.Errorf("got %s with %d bytes, awaited smaller than %d", name, len(b), len(diff))
+	}
+	r, err := fetcher.NewSniffingDecompressor(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, diff) {
+		t.Errorf("round trip mismatch: %v", err)
+	}
+
+	// an uncompressed zstd diff would be mistaken for a compressed one
+	zdiff := []byte{0x28, 0xb5, 0x2f, 0xfd, 1, 2, 3}
+	if _, _, err = compressDiff(zdiff, []string{fetcher.CompressNone}); err == nil {
+		t.Error("awaited error for an undetectable uncompressed zstd diff")
+	}
+	if name, _, err = compressDiff(zdiff, fetcher.Compressions); err != nil || name == fetcher.CompressNone {
+		t.Errorf("got %q, %v", name, err)
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	bi := &debug.BuildInfo{
+		GoVersion: "go1.22.1",
+		Main:      debug.Module{Path: "example.com/app", Version: "v1.2.3"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "0123456789abcdef0123"},
+			{Key: "vcs.time", Value: "2024-01-02T03:04:05Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+	got := fetcher.NewBuildInfo(bi)
+	await := fetcher.BuildInfo{
+		Path: "example.com/app", Version: "v1.2.3", Revision: "0123456789abcdef0123",
+		Time: "2024-01-02T03:04:05Z", Dirty: true, GoVersion: "go1.22.1",
+	}
+	if got == nil || *got != await {
+		t.Fatalf("got %+v, awaited %+v", got, await)
+	}
+	for _, tc := range []struct {
+		Build *fetcher.BuildInfo
+		Want  string
+	}{
+		{got, "v1.2.3 rev 0123456789ab-dirty"},
+		{&fetcher.BuildInfo{Version: "(devel)", Revision: "abc"}, "(devel) rev abc"},
+		{&fetcher.BuildInfo{GoVersion: "go1.22.1"}, "unknown"},
+		{nil, "unknown"},
+	} {
+		if s := tc.Build.String(); s != tc.Want {
+			t.Errorf("got %q, awaited %q", s, tc.Want)
+		}
+	}
+	if fetcher.NewBuildInfo(nil) != nil {
+		t.Error("awaited nil for nil")
+	}
+}
+
+func TestInfoBuild(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	src, err := os.Open(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dir, err := ioutil.TempDir("", "overseer-bindiff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tpl fetcher.Templates
+	if err := tpl.Init("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	plat := fetcher.Platform{GOOS: runtime.GOOS, GOARCH: runtime.GOARCH}
+	if _, err = createUpdate(dir, tpl, src, plat, nil, genOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, runtime.GOOS+"_"+runtime.GOARCH+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info fetcher.Info
+	if err := json.Unmarshal(b, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Build == nil || info.Build.GoVersion != runtime.Version() {
+		t.Errorf("got build info %+v, awaited %s", info.Build, runtime.Version())
+	}
+}
+
+// gzipped returns s compressed with gzip.
+func gzipped(s string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/overseer-bindiff/fetcher"
+)
+
+// manifestName is the name of the generate manifest in the output directory.
+const manifestName = ".overseer-bindiff.json"
+
+const (
+	kindBin  = "bin"
+	kindDiff = "diff"
+	kindInfo = "info"
+	kindSig  = "sig" // detached signature, as written by the earlier versions
+
+	kindChunk = "chunk"
+	kindIndex = "index"
+
+	kindRaw   = "raw"
+	kindZsync = "zsync"
+)
+
+// genManifest records the files written by generate, with their hashes,
+// to be able to tell which files generate created, and whether they have
+// been modified since.
+type genManifest struct {
+	// Files are keyed by their slash-separated path, relative to the output directory.
+	Files map[string]genFile
+}
+
+type genFile struct {
+	Kind string
+	fetcher.Platform
+	OldSha string `json:",omitempty"`
+	NewSha string
+	Format string `json:",omitempty"` // of the diff
+	// Compression is the outer compression of the diff, or of the binary
+	Compression string `json:",omitempty"`
+	Sha256      string // of the file's content
+	Size        int64
+}
+
+// readManifest reads the manifest from dir. A missing manifest is empty.
+func readManifest(dir string) (*genManifest, error) {
+	m := &genManifest{Files: make(map[string]genFile)}
+	b, err := ioutil.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, errors.Wrap(err, "read manifest")
+	}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, errors.Wrapf(err, "decode manifest %q", filepath.Join(dir, manifestName))
+	}
+	if m.Files == nil {
+		m.Files = make(map[string]genFile)
+	}
+	return m, nil
+}
+
+// stage stages the manifest with pub, so it is published with the files it records.
+func (m *genManifest) stage(pub *publisher) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	fh, err := pub.Create(manifestName)
+	if err != nil {
+		return err
+	}
+	_, err = fh.Write(b)
+	if closeErr := fh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return errors.Wrap(err, "write manifest")
+}
+
+// save writes the manifest into dir, atomically.
+func (m *genManifest) save(dir string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	fh, err := ioutil.TempFile(dir, manifestName+".")
+	if err != nil {
+		return errors.Wrap(err, "create manifest")
+	}
+	_, err = fh.Write(b)
+	if closeErr := fh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(fh.Name(), filepath.Join(dir, manifestName))
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return errors.Wrap(err, "write manifest")
+	}
+	return nil
+}
+
+// add records the file written to fn as rel.
+func (m *genManifest) add(rel, fn string, f genFile) error {
+	var err error
+	if f.Sha256, f.Size, err = hashFile(fn); err != nil {
+		return err
+	}
+	m.Files[filepath.ToSlash(rel)] = f
+	return nil
+}
+
+// check returns whether the file at dir/rel is the one recorded in the manifest.
+func (m *genManifest) check(dir, rel string) (bool, error) {
+	f, ok := m.Files[filepath.ToSlash(rel)]
+	if !ok {
+		return false, nil
+	}
+	sha, size, err := hashFile(filepath.Join(dir, rel))
+	if err != nil {
+		return false, err
+	}
+	return size == f.Size && sha == f.Sha256, nil
+}
+
+// has reports whether the diff between oldSha and newSha in the given format
+// is at dir/rel, as generate wrote it.
+func (m *genManifest) has(dir, rel, oldSha, newSha, format string) bool {
+	f, ok := m.Files[filepath.ToSlash(rel)]
+	if ok && f.Format == "" {
+		f.Format = fetcher.DiffBsdiff
+	}
+	if !ok || f.Kind != kindDiff || f.OldSha != oldSha || f.NewSha != newSha || f.Format != format {
+		return false
+	}
+	ok, err := m.check(dir, rel)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		log.Printf("check %q: %v", rel, err)
+	}
+	return ok
+}
+
+// clean removes the diffs of plat created by generate which are not towards newSha,
+// so no client will ask for them; but only if they are unmodified since.
+//
+// With dryRun, it only logs the files it would remove.
+func (m *genManifest) clean(dir string, plat fetcher.Platform, newSha string, dryRun bool) {
+	var rels []string
+	for rel, f := range m.Files {
+		if f.Kind == kindDiff && f.Platform == plat && f.NewSha != newSha {
+			rels = append(rels, rel)
+		}
+	}
+	sort.Strings(rels)
+	for _, rel := range rels {
+		fn := filepath.Join(dir, filepath.FromSlash(rel))
+		ok, err := m.check(dir, rel)
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				delete(m.Files, rel)
+			} else {
+				log.Printf("Keeping %q: %v", fn, err)
+			}
+			continue
+		}
+		if !ok {
+			log.Printf("Keeping %q: it has been modified since generated.", fn)
+			delete(m.Files, rel)
+			continue
+		}
+		if dryRun {
+			log.Printf("Would delete stale %q.", fn)
+			continue
+		}
+		log.Printf("Deleting stale %q.", fn)
+		if err := os.Remove(fn); err != nil {
+			log.Printf("ERROR deleting %q: %v", fn, err)
+			continue
+		}
+		delete(m.Files, rel)
+		os.Remove(filepath.Dir(fn)) // only succeeds if it is empty
+	}
+}
+
+func hashFile(fn string) (string, int64, error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "open %q", fn)
+	}
+	defer fh.Close()
+	h := fetcher.NewSha()
+	n, err := io.Copy(h, fh)
+	if err != nil {
+		return "", n, errors.Wrapf(err, "read %q", fn)
+	}
+	return fetcher.EncodeSha(h.Sum(nil)), n, nil
+}
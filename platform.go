@@ -0,0 +1,304 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/overseer-bindiff/fetcher"
+)
+
+var (
+	knownOS = []string{
+		"aix", "android", "darwin", "dragonfly", "freebsd", "illumos", "ios",
+		"js", "linux", "netbsd", "openbsd", "plan9", "solaris", "wasip1", "windows",
+	}
+	knownArch = []string{
+		"386", "amd64", "arm", "arm64", "loong64", "mips", "mipsle", "mips64",
+		"mips64le", "ppc64", "ppc64le", "riscv64", "s390x", "wasm",
+	}
+)
+
+func isKnown(list []string, s string) bool {
+	for _, k := range list {
+		if k == s {
+			return true
+		}
+	}
+	return false
+}
+
+// platformFromName parses the GOOS and GOARCH from a file name
+// such as myapp-linux-amd64 or myapp_windows_386.exe.
+func platformFromName(name string) (fetcher.Platform, bool) {
+	name = strings.TrimSuffix(strings.ToLower(filepath.Base(name)), ".exe")
+	parts := strings.FieldsFunc(name, func(r rune) bool {
+		return r == '-' || r == '_' || r == '.'
+	})
+	for i := len(parts) - 2; i >= 0; i-- {
+		if isKnown(knownOS, parts[i]) && isKnown(knownArch, parts[i+1]) {
+			return fetcher.Platform{GOOS: parts[i], GOARCH: parts[i+1]}, true
+		}
+	}
+	return fetcher.Platform{}, false
+}
+
+// target is a binary to generate the update for, with its platform.
+type target struct {
+	Path string
+	fetcher.Platform
+	// Given is true if the platform is given explicitly, by flags or by the file name.
+	Given bool
+}
+
+// findTargets returns the binaries to generate updates for.
+//
+// If appPath is a directory or a glob pattern, then every matching file
+// is a target, with the platform parsed from its name, or detected from its
+// executable headers if the name does not tell;
+// otherwise the one binary is returned with the default platform.
+//
+// The platforms are checked with checkPlatform later.
+func findTargets(appPath string, def fetcher.Platform, defGiven bool) ([]target, error) {
+	var files []string
+	if strings.ContainsAny(appPath, "*?[") {
+		var err error
+		if files, err = filepath.Glob(appPath); err != nil {
+			return nil, errors.Wrapf(err, "glob %q", appPath)
+		}
+		if len(files) == 0 {
+			return nil, errors.Errorf("no file matches %q", appPath)
+		}
+	} else {
+		fi, err := os.Stat(appPath)
+		if err != nil || !fi.IsDir() {
+			if appPath, err = getAppPath(appPath); err != nil {
+				return nil, err
+			}
+			if fi, err = os.Stat(appPath); err != nil {
+				return nil, err
+			}
+		}
+		if !fi.IsDir() {
+			return []target{{Path: appPath, Platform: def, Given: defGiven}}, nil
+		}
+		dh, err := os.Open(appPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open %q", appPath)
+		}
+		names, err := dh.Readdirnames(-1)
+		dh.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %q", appPath)
+		}
+		for _, nm := range names {
+			files = append(files, filepath.Join(appPath, nm))
+		}
+	}
+	sort.Strings(files)
+
+	targets := make([]target, 0, len(files))
+	seen := make(map[fetcher.Platform]string, len(files))
+	for _, fn := range files {
+		if fi, err := os.Stat(fn); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		plat, ok := platformFromName(fn)
+		if !ok {
+			var err error
+			if plat, err = detectPlatform(fn); err != nil {
+				log.Printf("Skipping %q: cannot determine its platform from the name or the headers: %v", fn, err)
+				continue
+			}
+		}
+		if prev, ok := seen[plat]; ok {
+			return nil, errors.Errorf("both %q and %q are for %s_%s", prev, fn, plat.GOOS, plat.GOARCH)
+		}
+		seen[plat] = fn
+		targets = append(targets, target{Path: fn, Platform: plat, Given: ok})
+	}
+	if len(targets) == 0 {
+		return nil, errors.Errorf("no binaries found in %q", appPath)
+	}
+	return targets, nil
+}
+
+// ErrUnknownFormat is returned by detectPlatform for files that are
+// neither ELF, nor PE, nor Mach-O executables.
+var ErrUnknownFormat = errors.New("unknown executable format")
+
+// detectPlatform returns the platform from the executable headers of the file.
+func detectPlatform(fn string) (fetcher.Platform, error) {
+	if f, err := elf.Open(fn); err == nil {
+		defer f.Close()
+		return elfPlatform(f)
+	}
+	if f, err := pe.Open(fn); err == nil {
+		defer f.Close()
+		plat := fetcher.Platform{GOOS: "windows"}
+		switch f.Machine {
+		case pe.IMAGE_FILE_MACHINE_AMD64:
+			plat.GOARCH = "amd64"
+		case pe.IMAGE_FILE_MACHINE_I386:
+			plat.GOARCH = "386"
+		case pe.IMAGE_FILE_MACHINE_ARMNT:
+			plat.GOARCH = "arm"
+		case pe.IMAGE_FILE_MACHINE_ARM64:
+			plat.GOARCH = "arm64"
+		default:
+			return plat, errors.Errorf("%q: unknown PE machine %#x", fn, f.Machine)
+		}
+		return plat, nil
+	}
+	if f, err := macho.Open(fn); err == nil {
+		defer f.Close()
+		plat := fetcher.Platform{GOOS: "darwin"}
+		switch f.Cpu {
+		case macho.CpuAmd64:
+			plat.GOARCH = "amd64"
+		case macho.CpuArm64:
+			plat.GOARCH = "arm64"
+		case macho.Cpu386:
+			plat.GOARCH = "386"
+		case macho.CpuArm:
+			plat.GOARCH = "arm"
+		default:
+			return plat, errors.Errorf("%q: unknown Mach-O cpu %v", fn, f.Cpu)
+		}
+		return plat, nil
+	}
+	if f, err := macho.OpenFat(fn); err == nil {
+		f.Close()
+		return fetcher.Platform{GOOS: "darwin"}, errors.Errorf("%q: universal Mach-O binaries are not supported", fn)
+	}
+	return fetcher.Platform{}, errors.Wrap(ErrUnknownFormat, fn)
+}
+
+func elfPlatform(f *elf.File) (fetcher.Platform, error) {
+	var plat fetcher.Platform
+	switch f.OSABI {
+	case elf.ELFOSABI_FREEBSD:
+		plat.GOOS = "freebsd"
+	case elf.ELFOSABI_NETBSD:
+		plat.GOOS = "netbsd"
+	case elf.ELFOSABI_OPENBSD:
+		plat.GOOS = "openbsd"
+	case elf.ELFOSABI_SOLARIS:
+		plat.GOOS = "solaris"
+	default:
+		plat.GOOS = "linux"
+		// Go marks the other BSDs with a note section, not with the OSABI.
+		for _, sect := range []struct{ name, goos string }{
+			{".note.netbsd.ident", "netbsd"},
+			{".note.openbsd.ident", "openbsd"},
+		} {
+			if f.Section(sect.name) != nil {
+				plat.GOOS = sect.goos
+				break
+			}
+		}
+	}
+	le := f.Data == elf.ELFDATA2LSB
+	switch f.Machine {
+	case elf.EM_X86_64:
+		plat.GOARCH = "amd64"
+	case elf.EM_386:
+		plat.GOARCH = "386"
+	case elf.EM_ARM:
+		plat.GOARCH = "arm"
+	case elf.EM_AARCH64:
+		plat.GOARCH = "arm64"
+	case elf.EM_PPC64:
+		plat.GOARCH = "ppc64"
+		if le {
+			plat.GOARCH = "ppc64le"
+		}
+	case elf.EM_MIPS:
+		plat.GOARCH = "mips"
+		if f.Class == elf.ELFCLASS64 {
+			plat.GOARCH = "mips64"
+		}
+		if le {
+			plat.GOARCH += "le"
+		}
+	case elf.EM_S390:
+		plat.GOARCH = "s390x"
+	case elf.EM_RISCV:
+		plat.GOARCH = "riscv64"
+	case elf.EM_LOONGARCH:
+		plat.GOARCH = "loong64"
+	default:
+		return plat, errors.Errorf("unknown ELF machine %v", f.Machine)
+	}
+	return plat, nil
+}
+
+// checkPlatform compares the platform of the target with the one detected
+// from the executable headers.
+//
+// If the platform is not given explicitly, the detected one is used;
+// if it is given and disagrees, an error is returned, unless force is true.
+func checkPlatform(t *target, force bool) error {
+	detected, err := detectPlatform(t.Path)
+	if err != nil {
+		if errors.Cause(err) == ErrUnknownFormat && t.Given {
+			log.Printf("%q: %v, using %s_%s", t.Path, err, t.GOOS, t.GOARCH)
+			return nil
+		}
+		if force {
+			log.Printf("WARN %v", err)
+			return nil
+		}
+		return err
+	}
+	if !t.Given {
+		t.Platform = detected
+		return nil
+	}
+	if detected == t.Platform || detected.GOARCH == t.GOARCH && sameOSFamily(t.GOOS, detected.GOOS) {
+		return nil
+	}
+	if force {
+		log.Printf("WARN %q seems to be for %s_%s, but publishing it as %s_%s as forced.",
+			t.Path, detected.GOOS, detected.GOARCH, t.GOOS, t.GOARCH)
+		return nil
+	}
+	return errors.Errorf("%q is for %s_%s, not %s_%s (use --force to publish it anyway)",
+		t.Path, detected.GOOS, detected.GOARCH, t.GOOS, t.GOARCH)
+}
+
+// osFamily maps the GOOS values to the one their executable headers are detected as.
+var osFamily = map[string]string{"android": "linux", "ios": "darwin", "illumos": "solaris"}
+
+// sameOSFamily reports whether an executable for the given GOOS is detected as detected.
+func sameOSFamily(given, detected string) bool {
+	return given == detected || osFamily[given] == detected
+}
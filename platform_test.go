@@ -0,0 +1,116 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/overseer-bindiff/fetcher"
+)
+
+func TestPlatformFromName(t *testing.T) {
+	for name, await := range map[string]fetcher.Platform{
+		"myapp-linux-amd64":        {GOOS: "linux", GOARCH: "amd64"},
+		"myapp-windows-386.exe":    {GOOS: "windows", GOARCH: "386"},
+		"/tmp/my_app_darwin_arm64": {GOOS: "darwin", GOARCH: "arm64"},
+		"myapp.linux.mips64le":     {GOOS: "linux", GOARCH: "mips64le"},
+		"myapp":                    {},
+		"myapp-amd64-linux":        {},
+	} {
+		got, ok := platformFromName(name)
+		if ok != (await != fetcher.Platform{}) || got != await {
+			t.Errorf("%q: got %v (%t), awaited %v.", name, got, ok, await)
+		}
+	}
+}
+
+func TestDetectPlatform(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	got, err := detectPlatform(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if await := (fetcher.Platform{GOOS: runtime.GOOS, GOARCH: runtime.GOARCH}); got != await {
+		t.Errorf("got %v, awaited %v.", got, await)
+	}
+
+	if _, err := detectPlatform("platform_test.go"); errors.Cause(err) != ErrUnknownFormat {
+		t.Errorf("got %v, awaited %v.", err, ErrUnknownFormat)
+	}
+}
+
+func TestFindTargets(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	b, err := ioutil.ReadFile(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "overseer-bindiff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, nm := range []string{"myapp", "README"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, nm), b, 0755); err != nil {
+			t.Fatal(err)
+		}
+		b = []byte("not a binary")
+	}
+
+	targets, err := findTargets(dir, fetcher.Platform{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	await := fetcher.Platform{GOOS: runtime.GOOS, GOARCH: runtime.GOARCH}
+	if len(targets) != 1 || targets[0].Platform != await || targets[0].Given {
+		t.Errorf("got %+v, awaited only myapp as %v", targets, await)
+	}
+	if err := checkPlatform(&targets[0], false); err != nil {
+		t.Error(err)
+	}
+
+	for goos, family := range osFamily {
+		if family != runtime.GOOS {
+			continue
+		}
+		tgt := target{Path: self, Platform: fetcher.Platform{GOOS: goos, GOARCH: runtime.GOARCH}, Given: true}
+		if err := checkPlatform(&tgt, false); err != nil {
+			t.Errorf("%s: %v", goos, err)
+		}
+	}
+	tgt := target{Path: self, Platform: fetcher.Platform{GOOS: "windows", GOARCH: runtime.GOARCH}, Given: true}
+	if runtime.GOOS != "windows" && checkPlatform(&tgt, false) == nil {
+		t.Error("windows is accepted")
+	}
+}
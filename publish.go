@@ -0,0 +1,195 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// publisher stages the files of an update in a temporary directory
+// under the output directory, and moves them into place on Commit.
+//
+// The files are committed in the order of their creation, so the info
+// (a signed message) should be created last, to let the clients see
+// a new info only after all the files it refers to are in place.
+// Each file is renamed over the live one, so the live path always exists.
+type publisher struct {
+	dir, staging string
+	files        []string // relative to dir, in creation order
+	dryRun       bool
+
+	beforeReplace func(dst string) // called before replacing dst, for testing
+}
+
+func newPublisher(dir string) (*publisher, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "create %q", dir)
+	}
+	staging, err := ioutil.TempDir(dir, ".staging-")
+	if err != nil {
+		return nil, errors.Wrapf(err, "create staging directory in %q", dir)
+	}
+	return &publisher{dir: dir, staging: staging}, nil
+}
+
+// newDryRunPublisher returns a publisher which stages the files in a temporary
+// directory outside of dir, and does not touch dir on Commit.
+func newDryRunPublisher(dir string) (*publisher, error) {
+	staging, err := ioutil.TempDir("", "overseer-bindiff-dry-run-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create staging directory")
+	}
+	return &publisher{dir: dir, staging: staging, dryRun: true}, nil
+}
+
+// Path returns the final (live) path of rel.
+func (p *publisher) Path(rel string) string { return filepath.Join(p.dir, rel) }
+
+// Staged returns the staging path of rel.
+func (p *publisher) Staged(rel string) string { return filepath.Join(p.staging, rel) }
+
+// Create creates the staged file for rel, which is relative to the output directory.
+func (p *publisher) Create(rel string) (*os.File, error) {
+	rel = filepath.Clean(rel)
+	fn := p.Staged(rel)
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return nil, errors.Wrapf(err, "create %q", filepath.Dir(fn))
+	}
+	fh, err := os.Create(fn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create %q", fn)
+	}
+	for _, f := range p.files {
+		if f == rel {
+			return fh, nil
+		}
+	}
+	p.files = append(p.files, rel)
+	return fh, nil
+}
+
+// Commit moves the staged files into place, in creation order.
+// On failure the already moved files are moved back.
+//
+// In dry-run mode, it only logs the files it would publish.
+func (p *publisher) Commit() error {
+	if p.dryRun {
+		for _, rel := range p.files {
+			var size int64
+			if fi, err := os.Stat(p.Staged(rel)); err == nil {
+				size = fi.Size()
+			}
+			log.Printf("Would publish %q (%d bytes).", p.Path(rel), size)
+		}
+		p.files = nil
+		return p.Abort()
+	}
+	backup := filepath.Join(p.staging, ".backup")
+	type done struct {
+		rel       string
+		hadBackup bool
+	}
+	var moved []done
+	rollback := func() {
+		for i := len(moved) - 1; i >= 0; i-- {
+			d := moved[i]
+			dst := p.Path(d.rel)
+			if d.hadBackup {
+				if err := os.Rename(filepath.Join(backup, d.rel), dst); err != nil {
+					log.Printf("ERROR restoring %q: %v", dst, err)
+				}
+			} else if err := os.Remove(dst); err != nil {
+				log.Printf("ERROR removing %q: %v", dst, err)
+			}
+		}
+	}
+
+	for _, rel := range p.files {
+		dst := p.Path(rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			rollback()
+			return errors.Wrapf(err, "create %q", filepath.Dir(dst))
+		}
+		d := done{rel: rel}
+		if _, err := os.Lstat(dst); err == nil {
+			bak := filepath.Join(backup, rel)
+			if err = os.MkdirAll(filepath.Dir(bak), 0755); err == nil {
+				err = linkOrCopy(dst, bak)
+			}
+			if err != nil {
+				rollback()
+				return errors.Wrapf(err, "backup %q", dst)
+			}
+			d.hadBackup = true
+		}
+		if p.beforeReplace != nil {
+			p.beforeReplace(dst)
+		}
+		// the live file is replaced in one step
+		if err := os.Rename(p.Staged(rel), dst); err != nil {
+			rollback()
+			return errors.Wrapf(err, "rename %q to %q", p.Staged(rel), dst)
+		}
+		log.Printf("Published %q.", dst)
+		moved = append(moved, d)
+	}
+	p.files = nil
+	return p.Abort()
+}
+
+// linkOrCopy hard links src to dst, or copies it if linking is not possible.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if closeErr := w.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Abort removes the staging directory with all the not yet committed files.
+func (p *publisher) Abort() error {
+	if p.staging == "" {
+		return nil
+	}
+	err := os.RemoveAll(p.staging)
+	p.staging = ""
+	return err
+}
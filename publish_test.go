@@ -0,0 +1,365 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tgulacsi/overseer-bindiff/fetcher"
+)
+
+func TestPublisher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overseer-bindiff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stage := func(pub *publisher, files ...string) {
+		for _, nm := range files {
+			fh, err := pub.Create(nm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fh.WriteString("new " + nm)
+			if err := fh.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	read := func(nm string) string {
+		b, _ := ioutil.ReadFile(filepath.Join(dir, nm))
+		return string(b)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "info.json"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := newPublisher(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage(pub, "a/bin", "info.json")
+	if got := read("info.json"); got != "old" {
+		t.Errorf("info.json changed before commit: %q", got)
+	}
+	if err := pub.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := read("info.json"); got != "new info.json" {
+		t.Errorf("got %q after commit", got)
+	}
+	if got := read("a/bin"); got != "new a/bin" {
+		t.Errorf("got %q after commit", got)
+	}
+
+	// "b" is a file, so "b/diff" cannot be committed: the rollback must restore "a/bin".
+	if err := ioutil.WriteFile(filepath.Join(dir, "b"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if pub, err = newPublisher(dir); err != nil {
+		t.Fatal(err)
+	}
+	fh, err := pub.Create("a/bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.WriteString("newer")
+	fh.Close()
+	stage(pub, "b/diff", "info.json")
+	if err := pub.Commit(); err == nil {
+		t.Fatal("commit succeeded")
+	}
+	pub.Abort()
+	if got := read("a/bin"); got != "new a/bin" {
+		t.Errorf("got %q after rollback", got)
+	}
+	if got := read("info.json"); got != "new info.json" {
+		t.Errorf("got %q after rollback", got)
+	}
+	if staging, _ := filepath.Glob(filepath.Join(dir, ".staging-*")); len(staging) != 0 {
+		t.Errorf("staging left behind: %q", staging)
+	}
+}
+
+func TestIncrementalGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overseer-bindiff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tpl fetcher.Templates
+	if err := tpl.Init("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	plat := fetcher.Platform{GOOS: "linux", GOARCH: "amd64"}
+	old := strings.Repeat("This is the old binary. ", 1000)
+	cur := strings.Repeat("This is the new binary! ", 1000)
+	var rep updateReport
+	for _, content := range []string{old, cur} {
+		if rep, err = createUpdate(dir, tpl, strings.NewReader(content), plat, nil, genOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	diffs, err := filepath.Glob(filepath.Join(dir, "linux_amd64", "*", rep.NewSha))
+	if err != nil || len(diffs) != 1 {
+		t.Fatalf("got diffs %q (%v), awaited one", diffs, err)
+	}
+	if len(rep.Diffs) != 1 || rep.Diffs[0].Status != diffWritten || rep.Diffs[0].Size == 0 {
+		t.Errorf("got report diffs %+v, awaited one written", rep.Diffs)
+	}
+	if rep.Diffs[0].Compression != fetcher.CompressNone || rep.Diffs[0].Size != rep.Diffs[0].RawSize {
+		t.Errorf("got diff %+v, awaited uncompressed by default", rep.Diffs[0])
+	}
+	fi, err := os.Stat(diffs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rep, err = createUpdate(dir, tpl, strings.NewReader(cur), plat, nil, genOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Diffs) != 1 || rep.Diffs[0].Status != diffSkipped {
+		t.Errorf("got report diffs %+v, awaited one skipped", rep.Diffs)
+	}
+	fi2, err := os.Stat(diffs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fi, fi2) {
+		t.Errorf("diff %q has been regenerated", diffs[0])
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overseer-bindiff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tpl fetcher.Templates
+	if err := tpl.Init("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	plat := fetcher.Platform{GOOS: "linux", GOARCH: "amd64"}
+	if _, err = createUpdate(dir, tpl, strings.NewReader(strings.Repeat("old ", 1000)), plat, nil, genOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	list := func() []string {
+		var files []string
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil {
+				files = append(files, path)
+			}
+			return err
+		})
+		return files
+	}
+	before := list()
+
+	rep, err := createUpdate(dir, tpl, strings.NewReader(strings.Repeat("new ", 1000)), plat, nil,
+		genOptions{DryRun: true, Clean: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Diffs) != 1 || rep.Diffs[0].Status != diffWritten || len(rep.Files) != 3 {
+		t.Errorf("got report %+v, awaited one diff and three files", rep)
+	}
+	if after := list(); strings.Join(before, "\n") != strings.Join(after, "\n") {
+		t.Errorf("dry run modified the output directory:\n%q\n%q", before, after)
+	}
+}
+
+func TestCommitKeepsLive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overseer-bindiff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info := filepath.Join(dir, "info.json")
+	if err := ioutil.WriteFile(info, []byte("0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const readers = 2
+	stop := make(chan struct{})
+	result := make(chan int, readers)
+	for i := 0; i < readers; i++ {
+		go func() {
+			var missing int
+			for {
+				select {
+				case <-stop:
+					result <- missing
+					return
+				default:
+				}
+				if _, err := os.Lstat(info); err != nil {
+					missing++
+				}
+			}
+		}()
+	}
+	const commits = 200
+	for i := 1; i <= commits; i++ {
+		pub, err := newPublisher(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub.beforeReplace = func(dst string) {
+			if _, err := os.Lstat(dst); err != nil {
+				t.Errorf("%q is missing before it is replaced: %v", dst, err)
+			}
+		}
+		fh, err := pub.Create("info.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(fh, "%d", i)
+		fh.Close()
+		if err := pub.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	var missing int
+	for i := 0; i < readers; i++ {
+		missing += <-result
+	}
+	if missing != 0 {
+		t.Errorf("info.json was missing %d times during the commits", missing)
+	}
+	if b, _ := ioutil.ReadFile(info); string(b) != fmt.Sprint(commits) {
+		t.Errorf("got %q, awaited the last commit", b)
+	}
+}
+
+func TestClean(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overseer-bindiff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tpl fetcher.Templates
+	if err := tpl.Init("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	plat := fetcher.Platform{GOOS: "linux", GOARCH: "amd64"}
+	var shas []string
+	for i, opts := range []genOptions{{}, {}, {}, {Clean: true}} {
+		if i == 3 {
+			// a hand-placed file, and a modified stale diff
+			if err := ioutil.WriteFile(filepath.Join(dir, "linux_amd64", shas[0], "handmade"), []byte("mine"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "linux_amd64", shas[0], shas[2]), []byte("modified"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		content := strings.Repeat(fmt.Sprintf("This is binary v%d. ", i+1), 1000)
+		rep, err := createUpdate(dir, tpl, strings.NewReader(content), plat, nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shas = append(shas, rep.NewSha)
+	}
+
+	exists := func(parts ...string) bool {
+		_, err := os.Stat(filepath.Join(append([]string{dir, "linux_amd64"}, parts...)...))
+		return err == nil
+	}
+	for _, tc := range []struct {
+		Path   []string
+		Exists bool
+	}{
+		{[]string{shas[0], shas[1]}, false},   // stale
+		{[]string{shas[1], shas[2]}, false},   // stale
+		{[]string{shas[0], shas[2]}, true},    // modified
+		{[]string{shas[0], "handmade"}, true}, // not generated
+		{[]string{shas[0], shas[3]}, true},    // current
+		{[]string{shas[1], shas[3]}, true},    // current
+		{[]string{shas[2], shas[3]}, true},    // current
+		{[]string{shas[0] + ".gz"}, true},     // binary
+	} {
+		if got := exists(tc.Path...); got != tc.Exists {
+			t.Errorf("%s: exists=%t, awaited %t", filepath.Join(tc.Path...), got, tc.Exists)
+		}
+	}
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range []string{
+		"linux_amd64/" + shas[0] + "/" + shas[1],
+		"linux_amd64/" + shas[0] + "/" + shas[2],
+	} {
+		if _, ok := manifest.Files[rel]; ok {
+			t.Errorf("%q is still in the manifest", rel)
+		}
+	}
+}
+
+func TestCommitManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overseer-bindiff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := newPublisher(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Abort()
+	if err = writeSigned(pub, "linux_amd64.json", []byte("{}"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = manifest.add("linux_amd64.json", pub.Staged("linux_amd64.json"), genFile{Kind: kindInfo}); err != nil {
+		t.Fatal(err)
+	}
+	if err = manifest.stage(pub); err != nil {
+		t.Fatal(err)
+	}
+	// the manifest cannot be replaced, so nothing is published
+	if err = os.MkdirAll(filepath.Join(dir, manifestName, "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.Commit(); err == nil {
+		t.Fatal("awaited error for the unwritable manifest")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "linux_amd64.json")); !os.IsNotExist(err) {
+		t.Errorf("the info not recorded in the manifest is published: %v", err)
+	}
+}
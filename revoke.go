@@ -0,0 +1,279 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/tgulacsi/overseer-bindiff/fetcher"
+)
+
+func revokeCommand() *cobra.Command {
+	var dir, goos, goarch, infoPath, keyringPath, to string
+	var undo bool
+	cmd := &cobra.Command{
+		Use:   "revoke <sha256 or binary>...",
+		Short: "mark releases as pulled in the signed info, so the clients won't install them",
+		Run: func(_ *cobra.Command, args []string) {
+			if len(args) == 0 {
+				log.Fatal("A release's sha256 or binary is a must!")
+			}
+			shas := make([][]byte, 0, len(args))
+			for _, arg := range args {
+				sha, err := releaseSha(arg)
+				if err != nil {
+					log.Fatal(err)
+				}
+				shas = append(shas, sha)
+			}
+			var toSha []byte
+			if to != "" {
+				if undo {
+					log.Fatal("--to cannot be used with --undo")
+				}
+				var err error
+				if toSha, err = releaseSha(to); err != nil {
+					log.Fatal(err)
+				}
+			}
+			keyring, err := readKeyringFile(keyringPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			var tpl fetcher.Templates
+			if err := tpl.Init(infoPath, "", ""); err != nil {
+				log.Fatal(err)
+			}
+			var plats []fetcher.Platform
+			for _, o := range knownOS {
+				for _, a := range knownArch {
+					if (goos == "" || goos == o) && (goarch == "" || goarch == a) {
+						plats = append(plats, fetcher.Platform{GOOS: o, GOARCH: a})
+					}
+				}
+			}
+			n, err := revokeTree(dir, tpl, plats, shas, toSha, undo, keyring)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if n == 0 {
+				log.Fatalf("No info found in %q.", dir)
+			}
+		},
+	}
+	F := cmd.Flags()
+	F.StringVar(&dir, "dir", "public", "the generated update tree")
+	F.StringVar(&goos, "os", "", "only this OS")
+	F.StringVar(&goarch, "arch", "", "only this ARCH")
+	F.BoolVar(&undo, "undo", false, "remove the releases from the revoked list")
+	F.StringVar(&to, "to", "", "the published release (sha256 or binary) the clients go to instead of the revoked latest one")
+	F.StringVar(&infoPath, "info", fetcher.DefaultInfoPath, "info path template")
+	F.StringVar(&keyringPath, "keyring", "", "gpg keyring to use")
+	return cmd
+}
+
+// releaseSha returns the sha256 of the binary at arg, or arg decoded.
+func releaseSha(arg string) ([]byte, error) {
+	if fi, err := os.Stat(arg); err == nil && fi.Mode().IsRegular() {
+		sha, _, err := hashFile(arg)
+		if err != nil {
+			return nil, err
+		}
+		return fetcher.DecodeSha(sha)
+	}
+	sha, err := fetcher.DecodeSha(arg)
+	if err != nil || len(sha) != fetcher.NewSha().Size() {
+		return nil, errors.Errorf("%q is neither a binary, nor a sha256", arg)
+	}
+	return sha, nil
+}
+
+// readInfoFile reads the info at fn, without checking its signature.
+// A missing info is empty.
+func readInfoFile(fn string) (fetcher.Info, error) {
+	var info fetcher.Info
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return info, nil
+		}
+		return info, errors.Wrapf(err, "read %q", fn)
+	}
+	if fetcher.IsSignedMessage(b) {
+		if b, err = fetcher.ReadSigned(b, nil); err != nil {
+			return info, errors.Wrapf(err, "read %q", fn)
+		}
+	}
+	return info, errors.Wrapf(json.Unmarshal(b, &info), "decode %q", fn)
+}
+
+// revokeTree adds the shas to (or with undo, removes them from) the revoked
+// list of the info of the platforms found under dir, and signs the info again.
+// If the latest release is revoked, and to is not nil, the release to is set
+// as its replacement.
+//
+// Returns the number of infos found.
+func revokeTree(dir string, tpl fetcher.Templates, plats []fetcher.Platform, shas [][]byte, to []byte, undo bool, keyring openpgp.EntityList) (int, error) {
+	if to != nil && containsSha(shas, to) {
+		return 0, errors.Errorf("the replacement %s is revoked", fetcher.EncodeSha(to))
+	}
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return 0, err
+	}
+	var pub *publisher
+	var found int
+	for _, plat := range plats {
+		rel, err := tpl.Execute(tpl.Info, fetcher.URLInfo{Platform: plat, IsEncrypted: keyring != nil})
+		if err != nil {
+			return found, errors.Wrap(err, "execute info template")
+		}
+		fn := filepath.Join(dir, rel)
+		if _, err = os.Stat(fn); err != nil {
+			continue
+		}
+		found++
+		if keyring == nil && isSigned(fn) {
+			return found, errors.Errorf("%q is signed, a keyring is needed for signing it again", fn)
+		}
+		info, err := readInfoFile(fn)
+		if err != nil {
+			return found, err
+		}
+		var revoked [][]byte
+		for _, r := range info.Revoked {
+			if !(undo && containsSha(shas, r)) {
+				revoked = append(revoked, r)
+			}
+		}
+		if !undo {
+			for _, sha := range shas {
+				if !containsSha(revoked, sha) {
+					revoked = append(revoked, sha)
+				}
+			}
+		}
+		info.Revoked = revoked
+		if to != nil && info.IsRevoked(info.Sha256) {
+			if info.IsRevoked(to) {
+				return found, errors.Errorf("the replacement %s is revoked", fetcher.EncodeSha(to))
+			}
+			if info.Replacement, err = replacementInfo(manifest, plat, to); err != nil {
+				return found, err
+			}
+		}
+		if info.Replacement != nil && (!info.IsRevoked(info.Sha256) || info.IsRevoked(info.Replacement.Sha256)) {
+			info.Replacement = nil
+		}
+		if info.Replacement != nil {
+			log.Printf("The latest release of %s_%s is revoked, the clients go to %s.",
+				plat.GOOS, plat.GOARCH, fetcher.EncodeSha(info.Replacement.Sha256))
+		} else if info.IsRevoked(info.Sha256) {
+			log.Printf("WARNING: the latest release of %s_%s is revoked, the clients stay on their version till a new one is generated.",
+				plat.GOOS, plat.GOARCH)
+		}
+
+		var buf bytes.Buffer
+		if err = json.NewEncoder(&buf).Encode(info); err != nil {
+			return found, err
+		}
+		if pub == nil {
+			if pub, err = newPublisher(dir); err != nil {
+				return found, err
+			}
+			defer pub.Abort()
+		}
+		if err = writeSigned(pub, rel, buf.Bytes(), keyring); err != nil {
+			return found, err
+		}
+		f := genFile{Kind: kindInfo, Platform: plat, NewSha: fetcher.EncodeSha(info.Sha256)}
+		if err = manifest.add(rel, pub.Staged(rel), f); err != nil {
+			return found, err
+		}
+		log.Printf("%s_%s: %d revoked releases.", plat.GOOS, plat.GOARCH, len(revoked))
+	}
+	if found == 0 {
+		return 0, nil
+	}
+	// all the infos are published in one commit, with the manifest
+	if err = manifest.stage(pub); err != nil {
+		return found, err
+	}
+	return found, pub.Commit()
+}
+
+// replacementInfo returns the info of the release sha of plat, published
+// earlier, as recorded in the manifest.
+func replacementInfo(m *genManifest, plat fetcher.Platform, sha []byte) (*fetcher.Info, error) {
+	newSha := fetcher.EncodeSha(sha)
+	info := fetcher.Info{Sha256: sha}
+	var published bool
+	for _, f := range m.Files {
+		if f.Platform != plat || f.NewSha != newSha {
+			continue
+		}
+		switch f.Kind {
+		case kindBin:
+			published = true
+			info.Compression, info.BinSize = f.Compression, f.Size
+		case kindDiff:
+			info.DiffFormat = f.Format
+		case kindIndex:
+			info.Chunked = true
+		case kindZsync:
+			info.Zsync = true
+		}
+	}
+	if !published {
+		return nil, errors.Errorf("the binary of %s is not published for %s_%s", newSha, plat.GOOS, plat.GOARCH)
+	}
+	return &info, nil
+}
+
+// isSigned reports whether the file at fn is signed: it is a signed message,
+// or has a detached signature.
+func isSigned(fn string) bool {
+	if _, err := os.Stat(fn + ".asc"); err == nil {
+		return true
+	}
+	b, err := ioutil.ReadFile(fn)
+	return err == nil && fetcher.IsSignedMessage(b)
+}
+
+func containsSha(shas [][]byte, sha []byte) bool {
+	for _, s := range shas {
+		if bytes.Equal(s, sha) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tgulacsi/overseer-bindiff/fetcher"
+)
+
+func TestRevoke(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overseer-bindiff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tpl fetcher.Templates
+	if err := tpl.Init("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	plat := fetcher.Platform{GOOS: "linux", GOARCH: "amd64"}
+	infoPath := filepath.Join(dir, "linux_amd64.json")
+	bad := strings.Repeat("This is the bad binary. ", 1000)
+	rep, err := createUpdate(dir, tpl, strings.NewReader(bad), plat, nil, genOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	badSha, _ := fetcher.DecodeSha(rep.NewSha)
+
+	if n, err := revokeTree(dir, tpl, []fetcher.Platform{plat}, [][]byte{badSha}, nil, false, nil); err != nil || n != 1 {
+		t.Fatalf("revoke: %d, %v", n, err)
+	}
+	info, err := readInfoFile(infoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsRevoked(badSha) {
+		t.Errorf("%s is not revoked: %+v", rep.NewSha, info)
+	}
+
+	// the revoked list is kept by generate, and a revoked release cannot be published
+	if _, err = createUpdate(dir, tpl, strings.NewReader("good"), plat, nil, genOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = readInfoFile(infoPath); err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsRevoked(badSha) {
+		t.Errorf("%s is not revoked after generate: %+v", rep.NewSha, info)
+	}
+	if _, err = createUpdate(dir, tpl, strings.NewReader(bad), plat, nil, genOptions{}); err == nil {
+		t.Error("awaited error for publishing a revoked release")
+	}
+
+	if _, err := revokeTree(dir, tpl, []fetcher.Platform{plat}, [][]byte{badSha}, nil, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = readInfoFile(infoPath); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Revoked) != 0 {
+		t.Errorf("got %+v after undo", info.Revoked)
+	}
+}
+
+func TestRevokeTo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overseer-bindiff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tpl fetcher.Templates
+	if err := tpl.Init("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	plats := []fetcher.Platform{{GOOS: "linux", GOARCH: "amd64"}}
+	infoPath := filepath.Join(dir, "linux_amd64.json")
+	var shas [][]byte
+	for _, s := range []string{"good", "bad"} {
+		rep, err := createUpdate(dir, tpl, strings.NewReader(strings.Repeat("This is the "+s+" binary. ", 1000)),
+			plats[0], nil, genOptions{Compression: fetcher.CompressXz})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sha, _ := fetcher.DecodeSha(rep.NewSha)
+		shas = append(shas, sha)
+	}
+	good, bad := shas[0], shas[1]
+
+	if _, err = revokeTree(dir, tpl, plats, [][]byte{bad}, fetcher.GetSha(strings.NewReader("unknown")), false, nil); err == nil {
+		t.Error("awaited error for an unpublished replacement")
+	}
+	if _, err = revokeTree(dir, tpl, plats, [][]byte{bad}, bad, false, nil); err == nil {
+		t.Error("awaited error for a revoked replacement")
+	}
+	if _, err = revokeTree(dir, tpl, plats, [][]byte{bad}, good, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	info, err := readInfoFile(infoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := info.Replacement; r == nil || !bytes.Equal(r.Sha256, good) ||
+		r.Compression != fetcher.CompressXz || r.BinSize == 0 || r.DiffFormat != "" {
+		t.Fatalf("got replacement %+v, awaited %s", r, fetcher.EncodeSha(good))
+	}
+	if target, ok := info.Target(); !ok || !bytes.Equal(target.Sha256, good) {
+		t.Errorf("got target %+v (%t), awaited %s", target, ok, fetcher.EncodeSha(good))
+	}
+
+	if _, err = revokeTree(dir, tpl, plats, [][]byte{bad}, nil, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = readInfoFile(infoPath); err != nil {
+		t.Fatal(err)
+	}
+	if info.Replacement != nil {
+		t.Errorf("got replacement %+v after undo", info.Replacement)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/tgulacsi/overseer-bindiff/fetcher"
+)
+
+func serveCommand() *cobra.Command {
+	var addr, certFile, keyFile, infoPath string
+	var maxAge time.Duration
+	cmd := &cobra.Command{
+		Use:   "serve [dir]",
+		Short: "serve the generated update tree over HTTP",
+		Run: func(_ *cobra.Command, args []string) {
+			dir := "public"
+			if len(args) > 0 {
+				dir = args[0]
+			}
+			var tpl fetcher.Templates
+			if err := tpl.Init(infoPath, "", ""); err != nil {
+				log.Fatal(err)
+			}
+			handler, err := newServeHandler(dir, tpl, maxAge)
+			if err != nil {
+				log.Fatal(err)
+			}
+			srv := &http.Server{
+				Addr:    addr,
+				Handler: logRequests(handler),
+			}
+			if certFile != "" || keyFile != "" {
+				log.Printf("Serving %q on https://%s", dir, addr)
+				err = srv.ListenAndServeTLS(certFile, keyFile)
+			} else {
+				log.Printf("Serving %q on http://%s", dir, addr)
+				err = srv.ListenAndServe()
+			}
+			log.Fatal(err)
+		},
+	}
+	F := cmd.Flags()
+	F.StringVar(&addr, "addr", ":8080", "address to listen on")
+	F.StringVar(&certFile, "cert", "", "TLS certificate file")
+	F.StringVar(&keyFile, "key", "", "TLS key file")
+	F.StringVar(&infoPath, "info", fetcher.DefaultInfoPath, "info path template")
+	F.DurationVar(&maxAge, "max-age", 365*24*time.Hour, "cache max-age of the binaries and diffs")
+	return cmd
+}
+
+// newServeHandler returns a handler serving the files under dir.
+//
+// Directory listings and hidden files are not served.
+// The binaries and diffs are named by their content, so they are cacheable for
+// maxAge, but the info files (as named by tpl.Info, and their .asc signatures)
+// must be revalidated on each request.
+func newServeHandler(dir string, tpl fetcher.Templates, maxAge time.Duration) (http.Handler, error) {
+	mutable := make(map[string]bool)
+	for _, goos := range knownOS {
+		for _, goarch := range knownArch {
+			for _, encrypted := range []bool{false, true} {
+				nm, err := tpl.Execute(tpl.Info, fetcher.URLInfo{
+					Platform: fetcher.Platform{GOOS: goos, GOARCH: goarch}, IsEncrypted: encrypted,
+				})
+				if err != nil {
+					return nil, errors.Wrap(err, "execute info template")
+				}
+				nm = path.Clean("/" + nm)
+				mutable[nm], mutable[nm+".asc"] = true, true
+			}
+		}
+	}
+	root := http.Dir(dir)
+	immutable := fmt.Sprintf("public, max-age=%d, immutable", int64(maxAge/time.Second))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := path.Clean("/" + r.URL.Path)
+		if strings.Contains(name, "/.") {
+			http.NotFound(w, r)
+			return
+		}
+		f, err := root.Open(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, fi.Size(), fi.ModTime().UnixNano()))
+		if mutable[name] {
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Cache-Control", immutable)
+		}
+		http.ServeContent(w, r, name, fi.ModTime(), f)
+	}), nil
+}
+
+// logRequests logs each request, with the response status, size and duration.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(lw, r)
+		log.Printf("%s %s %q %d %d %s", r.RemoteAddr, r.Method, r.URL.RequestURI(),
+			lw.status, lw.size, time.Since(start))
+	})
+}
+
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+	return n, err
+}
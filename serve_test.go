@@ -0,0 +1,122 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tgulacsi/overseer-bindiff/fetcher"
+)
+
+func TestServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overseer-bindiff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "linux_amd64"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for nm, content := range map[string]string{
+		"linux_amd64.json":           `{"Sha256":""}`,
+		"linux_amd64/bbb.gz":         "0123456789",
+		"linux_amd64/index/bbb.json": `{}`,
+		"latest/linux-amd64":         `{"Sha256":""}`,
+		".staging/secret.json":       "secret",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, nm)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, nm), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tpl fetcher.Templates
+	if err := tpl.Init("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := newServeHandler(dir, tpl, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	get := func(path string, hdr ...string) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("/linux_amd64.json")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Errorf("info: got %d %q", resp.StatusCode, resp.Header.Get("Cache-Control"))
+	}
+	if resp = get("/linux_amd64/index/bbb.json"); resp.Header.Get("Cache-Control") == "no-cache" {
+		t.Errorf("index: got %q", resp.Header.Get("Cache-Control"))
+	}
+	// a custom info template
+	custom := tpl
+	if err := custom.Init("latest/{{.GOOS}}-{{.GOARCH}}", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if handler, err = newServeHandler(dir, custom, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/latest/linux-amd64", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("custom info: got %d %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+
+	resp = get("/linux_amd64/bbb.gz", "Range", "bytes=2-5")
+	if resp.StatusCode != http.StatusPartialContent || resp.ContentLength != 4 {
+		t.Errorf("range: got %d with length %d", resp.StatusCode, resp.ContentLength)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+	if resp = get("/linux_amd64/bbb.gz", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("If-None-Match: got %d", resp.StatusCode)
+	}
+	for _, path := range []string{"/.staging/secret.json", "/linux_amd64/", "/nothing"} {
+		if resp = get(path); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: got %d", path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/tgulacsi/overseer-bindiff/fetcher"
+)
+
+const (
+	problemMissing  = "MISSING"
+	problemCorrupt  = "CORRUPT"
+	problemUnsigned = "UNSIGNED"
+)
+
+// problem is an inconsistency found by verifyTree.
+type problem struct {
+	Kind, Path string
+	Err        error
+}
+
+func (p problem) String() string {
+	if p.Err == nil {
+		return p.Kind + " " + p.Path
+	}
+	return fmt.Sprintf("%s %s: %v", p.Kind, p.Path, p.Err)
+}
+
+func verifyCommand() *cobra.Command {
+	var infoPath, diffPath, binPath, indexPath, chunkPath, rawPath, zsyncPath, keyringPath string
+	cmd := &cobra.Command{
+		Use:   "verify [dir]",
+		Short: "verify the consistency of the generated update tree",
+		Run: func(_ *cobra.Command, args []string) {
+			dir := "public"
+			if len(args) > 0 {
+				dir = args[0]
+			}
+			keyring, err := readKeyringFile(keyringPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			var tpl fetcher.Templates
+			if err := tpl.Init(infoPath, diffPath, binPath); err != nil {
+				log.Fatal(err)
+			}
+			if err := tpl.InitChunks(indexPath, chunkPath); err != nil {
+				log.Fatal(err)
+			}
+			if err := tpl.InitZsync(rawPath, zsyncPath); err != nil {
+				log.Fatal(err)
+			}
+			problems, err := verifyTree(dir, tpl, keyring)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, p := range problems {
+				fmt.Println(p)
+			}
+			if len(problems) != 0 {
+				log.Fatalf("Found %d problems in %q.", len(problems), dir)
+			}
+		},
+	}
+	F := cmd.Flags()
+	F.StringVar(&infoPath, "info", fetcher.DefaultInfoPath, "info path template")
+	F.StringVar(&diffPath, "diff", fetcher.DefaultDiffPath, "diff path template")
+	F.StringVar(&binPath, "bin", fetcher.DefaultBinPath, "binary path template")
+	F.StringVar(&indexPath, "index", fetcher.DefaultIndexPath, "chunk index path template")
+	F.StringVar(&chunkPath, "chunk", fetcher.DefaultChunkPath, "chunk path template")
+	F.StringVar(&rawPath, "raw", fetcher.DefaultRawPath, "uncompressed binary path template, for zsync")
+	F.StringVar(&zsyncPath, "zsync-control", fetcher.DefaultZsyncPath, "zsync control path template")
+	F.StringVar(&keyringPath, "keyring", "", "gpg keyring to use")
+	return cmd
+}
+
+// verifyTree checks every platform's update found under dir:
+// that the info is signed (when keyring is given), the binary matches the info,
+// all the diffs from the old binaries patch them into the new one,
+// and the chunks and the zsync files (if published) match the binary.
+func verifyTree(dir string, tpl fetcher.Templates, keyring openpgp.EntityList) ([]problem, error) {
+	if tpl.Index == nil {
+		if err := tpl.InitChunks("", ""); err != nil {
+			return nil, err
+		}
+	}
+	if tpl.Raw == nil {
+		if err := tpl.InitZsync("", ""); err != nil {
+			return nil, err
+		}
+	}
+	var problems []problem
+	var found int
+	for _, goos := range knownOS {
+		for _, goarch := range knownArch {
+			plat := fetcher.Platform{GOOS: goos, GOARCH: goarch}
+			infoPath, err := tpl.Execute(tpl.Info, fetcher.URLInfo{Platform: plat, IsEncrypted: keyring != nil})
+			if err != nil {
+				return problems, errors.Wrap(err, "execute info template")
+			}
+			infoPath = filepath.Join(dir, infoPath)
+			if _, err := os.Stat(infoPath); err != nil {
+				continue
+			}
+			found++
+			log.Printf("Verifying %s_%s.", goos, goarch)
+			probs, err := verifyPlatform(dir, infoPath, tpl, plat, keyring)
+			problems = append(problems, probs...)
+			if err != nil {
+				return problems, err
+			}
+		}
+	}
+	if found == 0 {
+		return nil, errors.Errorf("no info found in %q", dir)
+	}
+	return problems, nil
+}
+
+func verifyPlatform(dir, infoPath string, tpl fetcher.Templates, plat fetcher.Platform, keyring openpgp.EntityList) ([]problem, error) {
+	b, err := ioutil.ReadFile(infoPath)
+	if err != nil {
+		return []problem{{Kind: problemCorrupt, Path: infoPath, Err: err}}, nil
+	}
+	if keyring == nil && isSigned(infoPath) {
+		return nil, errors.Errorf("%q is signed, a keyring is needed for verifying it", infoPath)
+	}
+	b, problems := checkSignature(infoPath, b, keyring)
+	if b == nil {
+		return problems, nil
+	}
+	var info fetcher.Info
+	if err := json.Unmarshal(b, &info); err != nil {
+		return append(problems, problem{Kind: problemCorrupt, Path: infoPath, Err: err}), nil
+	}
+	if len(info.Sha256) != fetcher.NewSha().Size() {
+		return append(problems, problem{Kind: problemCorrupt, Path: infoPath, Err: errors.New("bad hash length")}), nil
+	}
+
+	ui := fetcher.URLInfo{
+		Platform:    plat,
+		NewSha:      fetcher.EncodeSha(info.Sha256),
+		Compression: info.Compression,
+		IsEncrypted: keyring != nil,
+	}
+	binPath, err := tpl.Execute(tpl.Bin, ui)
+	if err != nil {
+		return problems, errors.Wrap(err, "execute bin template")
+	}
+	binPath = filepath.Join(dir, binPath)
+	if err := checkBin(binPath, info.Sha256, keyring); err != nil {
+		kind := problemCorrupt
+		if os.IsNotExist(errors.Cause(err)) {
+			kind = problemMissing
+		}
+		problems = append(problems, problem{Kind: kind, Path: binPath, Err: err})
+	}
+	if info.Chunked {
+		problems = append(problems, verifyChunks(dir, tpl, ui, keyring)...)
+	}
+	if info.Zsync {
+		problems = append(problems, verifyZsync(dir, tpl, ui)...)
+	}
+
+	binDir, currentName := filepath.Split(binPath)
+	files, err := ioutil.ReadDir(binDir)
+	if err != nil {
+		return problems, nil
+	}
+	for _, file := range files {
+		if file.IsDir() || file.Name() == currentName {
+			continue
+		}
+		if ui.OldSha = shaFromBinName(file.Name(), keyring != nil); ui.OldSha == ui.NewSha {
+			continue
+		}
+		diffPath, err := tpl.Execute(tpl.Diff, ui)
+		if err != nil {
+			return problems, errors.Wrap(err, "execute diff template")
+		}
+		diffPath = filepath.Join(dir, diffPath)
+		if _, err := os.Stat(diffPath); err != nil {
+			problems = append(problems, problem{Kind: problemMissing, Path: diffPath, Err: err})
+			continue
+		}
+		if err := checkDiff(diffPath, filepath.Join(binDir, file.Name()), info, keyring); err != nil {
+			problems = append(problems, problem{Kind: problemCorrupt, Path: diffPath, Err: err})
+		}
+	}
+	return problems, nil
+}
+
+// checkSignature returns the content of b, read from path, and checks
+// its signature if keyring is not nil: b is a signed message, or (as generated
+// by the earlier versions) it has a detached signature.
+//
+// The content is nil if b is a signed message which cannot be read.
+func checkSignature(path string, b []byte, keyring openpgp.EntityList) ([]byte, []problem) {
+	if fetcher.IsSignedMessage(b) {
+		content, err := fetcher.ReadSigned(b, keyring)
+		if err != nil {
+			return nil, []problem{{Kind: problemCorrupt, Path: path, Err: err}}
+		}
+		return content, nil
+	}
+	if keyring == nil {
+		return b, nil
+	}
+	sig, err := os.Open(path + ".asc")
+	if err != nil {
+		return b, []problem{{Kind: problemUnsigned, Path: path, Err: err}}
+	}
+	_, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(b), sig)
+	sig.Close()
+	if err != nil {
+		return b, []problem{{Kind: problemCorrupt, Path: sig.Name(), Err: err}}
+	}
+	return b, nil
+}
+
+// fileProblem returns the problem of reading path failed with err.
+func fileProblem(path string, err error) problem {
+	kind := problemCorrupt
+	if os.IsNotExist(errors.Cause(err)) {
+		kind = problemMissing
+	}
+	return problem{Kind: kind, Path: path, Err: err}
+}
+
+// verifyChunks checks the chunk index of the binary described by ui,
+// and that its chunks assemble the binary.
+func verifyChunks(dir string, tpl fetcher.Templates, ui fetcher.URLInfo, keyring openpgp.EntityList) []problem {
+	rel, err := tpl.Execute(tpl.Index, ui)
+	if err != nil {
+		return []problem{{Kind: problemCorrupt, Path: dir, Err: errors.Wrap(err, "execute index template")}}
+	}
+	indexPath := filepath.Join(dir, rel)
+	b, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return []problem{fileProblem(indexPath, err)}
+	}
+	b, problems := checkSignature(indexPath, b, keyring)
+	if b == nil {
+		return problems
+	}
+	var idx fetcher.ChunkIndex
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return append(problems, problem{Kind: problemCorrupt, Path: indexPath, Err: err})
+	}
+	if fetcher.EncodeSha(idx.Sha256) != ui.NewSha {
+		return append(problems, problem{Kind: problemCorrupt, Path: indexPath,
+			Err: errors.Errorf("index of %s, not %s", fetcher.EncodeSha(idx.Sha256), ui.NewSha)})
+	}
+
+	whole := fetcher.NewSha()
+	checked := make(map[string]bool, len(idx.Chunks))
+	bad := 0
+	for _, c := range idx.Chunks {
+		ui.ChunkSha = fetcher.EncodeSha(c.Sha256)
+		if rel, err = tpl.Execute(tpl.Chunk, ui); err != nil {
+			return append(problems, problem{Kind: problemCorrupt, Path: dir, Err: errors.Wrap(err, "execute chunk template")})
+		}
+		chunkPath := filepath.Join(dir, rel)
+		data, err := readChunk(chunkPath, keyring)
+		if err == nil && (int64(len(data)) != c.Size || !bytes.Equal(fetcher.GetSha(bytes.NewReader(data)), c.Sha256)) {
+			err = errors.Errorf("chunk mismatch: got %d bytes with hash %s", len(data), fetcher.EncodeSha(fetcher.GetSha(bytes.NewReader(data))))
+		}
+		if err != nil {
+			if !checked[chunkPath] {
+				problems = append(problems, fileProblem(chunkPath, err))
+			}
+			checked[chunkPath] = true
+			bad++
+			continue
+		}
+		checked[chunkPath] = true
+		whole.Write(data)
+	}
+	if bad == 0 && fetcher.EncodeSha(whole.Sum(nil)) != ui.NewSha {
+		problems = append(problems, problem{Kind: problemCorrupt, Path: indexPath,
+			Err: errors.Errorf("chunks assemble %s", fetcher.EncodeSha(whole.Sum(nil)))})
+	}
+	return problems
+}
+
+func readChunk(chunkPath string, keyring openpgp.EntityList) ([]byte, error) {
+	fh, err := os.Open(chunkPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	r := io.Reader(fh)
+	if keyring != nil {
+		if r, err = decrypt(r, keyring); err != nil {
+			return nil, err
+		}
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "gunzip %q", chunkPath)
+	}
+	return ioutil.ReadAll(io.LimitReader(gr, fetcher.MaxChunkSize+1))
+}
+
+// verifyZsync checks the raw binary described by ui, and its zsync control.
+func verifyZsync(dir string, tpl fetcher.Templates, ui fetcher.URLInfo) []problem {
+	rel, err := tpl.Execute(tpl.Zsync, ui)
+	if err != nil {
+		return []problem{{Kind: problemCorrupt, Path: dir, Err: errors.Wrap(err, "execute zsync template")}}
+	}
+	ctrlPath := filepath.Join(dir, rel)
+	b, err := ioutil.ReadFile(ctrlPath)
+	if err != nil {
+		return []problem{fileProblem(ctrlPath, err)}
+	}
+	var ctrl fetcher.ZsyncControl
+	if err := json.Unmarshal(b, &ctrl); err != nil {
+		return []problem{{Kind: problemCorrupt, Path: ctrlPath, Err: err}}
+	}
+	if rel, err = tpl.Execute(tpl.Raw, ui); err != nil {
+		return []problem{{Kind: problemCorrupt, Path: dir, Err: errors.Wrap(err, "execute raw template")}}
+	}
+	rawPath := filepath.Join(dir, rel)
+	fh, err := os.Open(rawPath)
+	if err != nil {
+		return []problem{fileProblem(rawPath, err)}
+	}
+	got, err := fetcher.NewZsyncControl(fh, ctrl.BlockSize)
+	fh.Close()
+	if err != nil {
+		return []problem{{Kind: problemCorrupt, Path: rawPath, Err: err}}
+	}
+	if fetcher.EncodeSha(got.Sha256) != ui.NewSha {
+		return []problem{{Kind: problemCorrupt, Path: rawPath,
+			Err: errors.Errorf("hash mismatch: got %s, awaited %s", fetcher.EncodeSha(got.Sha256), ui.NewSha)}}
+	}
+	if !bytes.Equal(ctrl.Sha256, got.Sha256) || ctrl.Size != got.Size ||
+		!bytes.Equal(ctrl.Strong, got.Strong) || len(ctrl.Weak) != len(got.Weak) {
+		return []problem{{Kind: problemCorrupt, Path: ctrlPath, Err: errors.New("block checksums mismatch the raw binary")}}
+	}
+	for i, w := range got.Weak {
+		if ctrl.Weak[i] != w {
+			return []problem{{Kind: problemCorrupt, Path: ctrlPath, Err: errors.Errorf("weak checksum of block %d mismatch", i)}}
+		}
+	}
+	return nil
+}
+
+func checkBin(binPath string, sha []byte, keyring openpgp.EntityList) error {
+	r, err := openBin(binPath, keyring)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h := fetcher.NewSha()
+	if _, err := io.Copy(h, r); err != nil {
+		return errors.Wrapf(err, "read %q", binPath)
+	}
+	if !bytes.Equal(h.Sum(nil), sha) {
+		return errors.Errorf("hash mismatch: got %s, awaited %s", fetcher.EncodeSha(h.Sum(nil)), fetcher.EncodeSha(sha))
+	}
+	return nil
+}
+
+func checkDiff(diffPath, oldPath string, info fetcher.Info, keyring openpgp.EntityList) error {
+	format, err := fetcher.GetDiffFormat(info.DiffFormat)
+	if err != nil {
+		return err
+	}
+	old, err := openBin(oldPath, keyring)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	fh, err := os.Open(diffPath)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	patch := io.Reader(fh)
+	if keyring != nil {
+		if patch, err = decrypt(patch, keyring); err != nil {
+			return err
+		}
+	}
+	dr, err := fetcher.NewSniffingDecompressor(patch)
+	if err != nil {
+		return errors.Wrapf(err, "decompress %q", diffPath)
+	}
+	defer dr.Close()
+	h := fetcher.NewSha()
+	if err := format.Patch(old, h, dr); err != nil {
+		return errors.Wrapf(err, "patch %q with %q", oldPath, diffPath)
+	}
+	if !bytes.Equal(h.Sum(nil), info.Sha256) {
+		return errors.Errorf("patched hash mismatch: got %s, awaited %s", fetcher.EncodeSha(h.Sum(nil)), fetcher.EncodeSha(info.Sha256))
+	}
+	return nil
+}
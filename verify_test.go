@@ -0,0 +1,218 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/tgulacsi/overseer-bindiff/fetcher"
+)
+
+func TestVerifyTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overseer-bindiff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tpl fetcher.Templates
+	if err := tpl.Init("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	plat := fetcher.Platform{GOOS: "linux", GOARCH: "amd64"}
+	var rep updateReport
+	for _, content := range []string{
+		strings.Repeat("This is the old binary. ", 1000),
+		strings.Repeat("This is the new binary! ", 1000),
+	} {
+		if rep, err = createUpdate(dir, tpl, strings.NewReader(content), plat, nil, genOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err := verifyTree(dir, tpl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("got problems %v for a consistent tree", problems)
+	}
+
+	diffs, err := filepath.Glob(filepath.Join(dir, "linux_amd64", "*", rep.NewSha))
+	if err != nil || len(diffs) != 1 {
+		t.Fatalf("got diffs %q (%v), awaited one", diffs, err)
+	}
+	b, err := ioutil.ReadFile(diffs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(diffs[0], bytes.ToUpper(b[:len(b)/2]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "linux_amd64", rep.NewSha+".gz")); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err = verifyTree(dir, tpl, nil); err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]int)
+	for _, p := range problems {
+		t.Log(p)
+		kinds[p.Kind]++
+	}
+	if kinds[problemMissing] != 1 || kinds[problemCorrupt] != 1 {
+		t.Errorf("got %v, awaited one missing and one corrupt", kinds)
+	}
+}
+
+func TestVerifyChunksZsync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overseer-bindiff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tpl fetcher.Templates
+	if err := tpl.Init("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := tpl.InitChunks("", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := tpl.InitZsync("", ""); err != nil {
+		t.Fatal(err)
+	}
+	plat := fetcher.Platform{GOOS: "linux", GOARCH: "amd64"}
+	content := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	rep, err := createUpdate(dir, tpl, bytes.NewReader(content), plat, nil, genOptions{Chunks: true, Zsync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := verifyTree(dir, tpl, nil); err != nil || len(problems) != 0 {
+		t.Fatalf("got problems %v (%v) for a consistent tree", problems, err)
+	}
+
+	chunks, err := filepath.Glob(filepath.Join(dir, "linux_amd64", "chunks", "*"))
+	if err != nil || len(chunks) < 2 {
+		t.Fatalf("got chunks %q (%v)", chunks, err)
+	}
+	if err := os.Remove(chunks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(chunks[1], gzipped("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	raw := filepath.Join(dir, "linux_amd64", "raw", rep.NewSha)
+	content[len(content)/2]++
+	if err := ioutil.WriteFile(raw, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := verifyTree(dir, tpl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, p := range problems {
+		t.Log(p)
+		got[p.Path] = p.Kind
+	}
+	if len(problems) != 3 || got[chunks[0]] != problemMissing || got[chunks[1]] != problemCorrupt || got[raw] != problemCorrupt {
+		t.Errorf("got %v, awaited a missing and a corrupt chunk, and a corrupt raw binary", problems)
+	}
+}
+
+func TestVerifySigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overseer-bindiff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	genKeyring := func() openpgp.EntityList {
+		var buf bytes.Buffer
+		setBits := WithRSABits(512)
+		if err := genAndSer(&buf, "test.producer@example.com", "Producer", "overseer-bindiff", "", setBits); err != nil {
+			t.Fatal(err)
+		}
+		if err := genAndSer(&buf, "test.consumer@example.com", "Consumer", "overseer-bindiff", "", setBits); err != nil {
+			t.Fatal(err)
+		}
+		return readKeyring(bytes.NewReader(buf.Bytes()))
+	}
+	keyring := genKeyring()
+
+	var tpl fetcher.Templates
+	if err := tpl.Init("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	plat := fetcher.Platform{GOOS: "linux", GOARCH: "amd64"}
+	if _, err = createUpdate(dir, tpl, strings.NewReader("This is the binary."), plat, keyring, genOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	infoPath := filepath.Join(dir, "linux_amd64.json")
+	b, err := ioutil.ReadFile(infoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fetcher.IsSignedMessage(b) {
+		t.Errorf("the info is not a signed message: %q", b)
+	}
+	if _, err = os.Stat(infoPath + ".asc"); !os.IsNotExist(err) {
+		t.Errorf("detached signature is written: %v", err)
+	}
+	if problems, err := verifyTree(dir, tpl, keyring); err != nil || len(problems) != 0 {
+		t.Fatalf("got %v (%v), awaited no problems", problems, err)
+	}
+	if _, err = verifyTree(dir, tpl, nil); err == nil {
+		t.Error("awaited error for verifying a signed tree without a keyring")
+	}
+
+	// signed by another publisher
+	content, err := fetcher.ReadSigned(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = fetcher.WriteSigned(&buf, content, genKeyring()); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(infoPath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := verifyTree(dir, tpl, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Path != infoPath || problems[0].Kind != problemCorrupt {
+		t.Errorf("got %v, awaited the bad signature of %q", problems, infoPath)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/overseer-bindiff/fetcher"
+)
+
+// writeZsync stages the uncompressed binary read from src, for the HTTP Range
+// requests of the clients, and its block checksums.
+//
+// The raw binary cannot be encrypted, so this is for unencrypted updates only.
+func writeZsync(pub *publisher, tpl fetcher.Templates, info fetcher.URLInfo, src io.Reader, record func(string, genFile) error) error {
+	rel, err := tpl.Execute(tpl.Raw, info)
+	if err != nil {
+		return errors.Wrap(err, "execute raw template")
+	}
+	fh, err := pub.Create(rel)
+	if err != nil {
+		return err
+	}
+	ctrl, err := fetcher.NewZsyncControl(io.TeeReader(src, fh), fetcher.DefaultZsyncBlockSize)
+	if closeErr := fh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "write %q", fh.Name())
+	}
+	if err = record(rel, genFile{Kind: kindRaw}); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(ctrl)
+	if err != nil {
+		return err
+	}
+	if rel, err = tpl.Execute(tpl.Zsync, info); err != nil {
+		return errors.Wrap(err, "execute zsync template")
+	}
+	log.Printf("Writing zsync control of %d blocks to %q.", len(ctrl.Weak), pub.Path(rel))
+	if err = writeSigned(pub, rel, b, nil); err != nil {
+		return err
+	}
+	return record(rel, genFile{Kind: kindZsync})
+}